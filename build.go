@@ -3,6 +3,7 @@ package xpath
 import (
 	"errors"
 	"fmt"
+	"sort"
 )
 
 type flag int
@@ -41,6 +42,18 @@ var builderProps = struct {
 type builder struct {
 	parseDepth int
 	firstInput query
+	variables  map[string]bool   // the declared variable names
+	scoped     map[string]int    // the variables bound by an enclosing for, some, every or let
+	free       map[string]bool   // the referenced variables whose values are passed to the evaluation
+	namespaces map[string]string // the namespace prefix bindings
+	functions  FunctionResolver
+	strict     bool
+	custom     bool // strict mode allows the custom functions
+	atomic     bool // the context item may be atomic, in the right operand of !
+	maxDepth   int
+	idAttrs    []string // the names of the ID attributes used by id()
+	formats    map[string]*DecimalFormat
+	keys       map[string]Key
 }
 
 // axisPredicate creates a predicate to predicating for this axis node.
@@ -79,7 +92,7 @@ func (b *builder) processAxis(root *axisNode, flags flag, props *builderProp) (q
 	predicate := axisPredicate(root)
 
 	if root.Input == nil {
-		qyInput = &contextQuery{}
+		qyInput = &contextQuery{Atomic: b.atomic}
 		*props = builderProps.None
 	} else {
 		inputFlags := flagsEnum.None
@@ -93,7 +106,7 @@ func (b *builder) processAxis(root *axisNode, flags flag, props *builderProp) (q
 							return nil, err
 						}
 					} else {
-						qyGrandInput = &contextQuery{}
+						qyGrandInput = &contextQuery{Atomic: b.atomic}
 					}
 					qyOutput = &descendantQuery{name: root.LocalName, Input: qyGrandInput, Predicate: predicate, Self: false}
 					*props |= builderProps.NonFlat
@@ -121,7 +134,9 @@ func (b *builder) processAxis(root *axisNode, flags flag, props *builderProp) (q
 	case "attribute":
 		qyOutput = &attributeQuery{name: root.LocalName, Input: qyInput, Predicate: predicate}
 	case "child":
-		if (*props & builderProps.NonFlat) == 0 {
+		if input, ok := qyInput.(*descendantQuery); ok && nodeOrder(input.Input) <= orderFlat {
+			qyOutput = &descendantChildQuery{name: root.LocalName, Self: input.Self, Input: input.Input, Parent: input.Predicate, Predicate: predicate}
+		} else if (*props & builderProps.NonFlat) == 0 {
 			qyOutput = &childQuery{name: root.LocalName, Input: qyInput, Predicate: predicate}
 		} else {
 			qyOutput = &cachedChildQuery{name: root.LocalName, Input: qyInput, Predicate: predicate}
@@ -146,7 +161,20 @@ func (b *builder) processAxis(root *axisNode, flags flag, props *builderProp) (q
 	case "following-sibling":
 		qyOutput = &followingQuery{Input: qyInput, Predicate: predicate, Sibling: true}
 	case "parent":
-		qyOutput = &parentQuery{Input: qyInput, Predicate: predicate}
+		parent := &parentQuery{Input: qyInput, Predicate: predicate}
+		switch input := qyInput.(type) {
+		case *childQuery:
+			parent.Siblings = input.Predicate
+		case *cachedChildQuery:
+			parent.Siblings = input.Predicate
+		case *descendantChildQuery:
+			parent.Siblings = input.Predicate
+		case *descendantQuery:
+			if !input.Self {
+				parent.Siblings = input.Predicate
+			}
+		}
+		qyOutput = parent
 	case "preceding":
 		qyOutput = &precedingQuery{Input: qyInput, Predicate: predicate}
 		*props |= builderProps.NonFlat
@@ -154,8 +182,11 @@ func (b *builder) processAxis(root *axisNode, flags flag, props *builderProp) (q
 		qyOutput = &precedingQuery{Input: qyInput, Predicate: predicate, Sibling: true}
 	case "self":
 		qyOutput = &selfQuery{Input: qyInput, Predicate: predicate}
+		if root.Input == nil && root.typeTest == allNode && b.atomic {
+			qyOutput = &contextItemQuery{Self: qyOutput}
+		}
 	case "namespace":
-		// haha,what will you do someting??
+		qyOutput = &namespaceQuery{name: root.LocalName, Input: qyInput, Predicate: predicate}
 	default:
 		err = fmt.Errorf("unknown axe type: %s", root.AxisType)
 		return nil, err
@@ -180,12 +211,29 @@ func (b *builder) processFilter(root *filterNode, flags flag, props *builderProp
 	}
 	firstInput := b.firstInput
 
+	// The predicate is evaluated for the nodes of the input.
 	var propsCond builderProp
+	atomic := b.atomic
+	b.atomic = false
 	cond, err := b.processNode(root.Condition, flags, &propsCond)
+	b.atomic = atomic
 	if err != nil {
 		return nil, err
 	}
 
+	// A number picks an integer of a range, which is not built.
+	input := qyInput
+	if g, ok := input.(*groupQuery); ok {
+		input = g.Input
+	}
+	if r, ok := input.(*rangeQuery); ok {
+		if c, ok := cond.(*constantQuery); ok {
+			if n, ok := c.Val.(float64); ok {
+				return &rangeItemQuery{Range: r, Position: n}, nil
+			}
+		}
+	}
+
 	// Checking whether is number
 	if canBeNumber(cond) || ((propsCond & (builderProps.HasPosition | builderProps.HasLast)) != 0) {
 		propsCond |= builderProps.HasPosition
@@ -278,6 +326,11 @@ func (b *builder) processFilter(root *filterNode, flags flag, props *builderProp
 					parent = axisQuery.Input
 					axisQuery.Input = rootQuery
 				}
+			case *descendantChildQuery:
+				// The positions are counted among the children of each
+				// parent, so the query is split back into its two steps.
+				parent = &descendantQuery{Self: axisQuery.Self, Input: axisQuery.Input, Predicate: axisQuery.Parent}
+				qyInput = &childQuery{name: axisQuery.name, Input: rootQuery, Predicate: axisQuery.Predicate}
 			}
 			b.firstInput = nil
 			child := &filterQuery{Input: qyInput, Predicate: cond, NoPosition: false}
@@ -302,302 +355,689 @@ func (b *builder) processFunction(root *functionNode, props *builderProp) (query
 	// Reset builder props
 	*props = builderProps.None
 
-	var qyOutput query
-	switch root.FuncName {
-	case "lower-case":
-		arg, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
-		}
-		qyOutput = &functionQuery{Func: lowerCaseFunc(arg)}
-	case "starts-with":
-		arg1, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
-		}
-		arg2, err := b.processNode(root.Args[1], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
-		}
-		qyOutput = &functionQuery{Func: startwithFunc(arg1, arg2)}
-	case "ends-with":
-		arg1, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
-		}
-		arg2, err := b.processNode(root.Args[1], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
+	if err := b.checkStrict(root); err != nil {
+		return nil, err
+	}
+	// A prefixed name is only a custom function.
+	if root.Prefix != "" {
+		ns, ok := b.namespaces[root.Prefix]
+		if !ok {
+			return nil, fmt.Errorf("xpath: undeclared namespace prefix %s in %s:%s()", root.Prefix, root.Prefix, root.FuncName)
 		}
-		qyOutput = &functionQuery{Func: endwithFunc(arg1, arg2)}
-	case "contains":
-		arg1, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
+		fn := b.lookupFunction(ns, root.FuncName)
+		if fn == nil {
+			return nil, fmt.Errorf("xpath: unknown function %s:%s()", root.Prefix, root.FuncName)
 		}
-		arg2, err := b.processNode(root.Args[1], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
+		return b.processCustomFunction(root, fn, props)
+	}
+	if build, ok := builtinFunctions[root.FuncName]; ok {
+		return build(b, root, props)
+	}
+	if fn := b.lookupFunction("", root.FuncName); fn != nil {
+		return b.processCustomFunction(root, fn, props)
+	}
+	return nil, fmt.Errorf("not yet support this function %s()", root.FuncName)
+}
+
+// builtinFunctions are the built-in functions, by name. processFunction
+// dispatches on it and function-available() looks names up in it.
+var builtinFunctions map[string]func(*builder, *functionNode, *builderProp) (query, error)
+
+func init() {
+	builtinFunctions = map[string]func(*builder, *functionNode, *builderProp) (query, error){
+		"lower-case":         (*builder).processLowerCaseFunc,
+		"upper-case":         (*builder).processUpperCaseFunc,
+		"starts-with":        (*builder).processStartsWithFunc,
+		"ends-with":          (*builder).processEndsWithFunc,
+		"contains":           (*builder).processContainsFunc,
+		"matches":            (*builder).processMatchesFunc,
+		"substring":          (*builder).processSubstringFunc,
+		"substring-before":   (*builder).processSubstringBeforeAfterFunc,
+		"substring-after":    (*builder).processSubstringBeforeAfterFunc,
+		"string-length":      (*builder).processStringLengthFunc,
+		"normalize-space":    (*builder).processNormalizeSpaceFunc,
+		"replace":            (*builder).processReplaceFunc,
+		"translate":          (*builder).processTranslateFunc,
+		"id":                 (*builder).processIDFunc,
+		"format-number":      (*builder).processFormatNumberFunc,
+		"key":                (*builder).processKeyFunc,
+		"function-available": (*builder).processXSLTFunc,
+		"element-available":  (*builder).processXSLTFunc,
+		"system-property":    (*builder).processXSLTFunc,
+		"lang":               (*builder).processLangFunc,
+		"not":                (*builder).processNotFunc,
+		"name":               (*builder).processNameFunc,
+		"local-name":         (*builder).processNameFunc,
+		"namespace-uri":      (*builder).processNameFunc,
+		"generate-id":        (*builder).processNameFunc,
+		"true":               (*builder).processTrueFalseFunc,
+		"false":              (*builder).processTrueFalseFunc,
+		"last":               (*builder).processLastFunc,
+		"position":           (*builder).processPositionFunc,
+		"boolean":            (*builder).processConversionFunc,
+		"number":             (*builder).processConversionFunc,
+		"string":             (*builder).processConversionFunc,
+		"count":              (*builder).processCountFunc,
+		"sum":                (*builder).processSumFunc,
+		"ceiling":            (*builder).processRoundingFunc,
+		"floor":              (*builder).processRoundingFunc,
+		"round":              (*builder).processRoundingFunc,
+		"concat":             (*builder).processConcatFunc,
+		"reverse":            (*builder).processReverseFunc,
+		"distinct-values":    (*builder).processDistinctValuesFunc,
+		"string-join":        (*builder).processStringJoinFunc,
+	}
+}
+
+// processLowerCaseFunc builds the query of lower-case().
+func (b *builder) processLowerCaseFunc(root *functionNode, props *builderProp) (query, error) {
+	arg, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: lowerCaseFunc(arg)}, nil
+}
+
+// processUpperCaseFunc builds the query of upper-case().
+func (b *builder) processUpperCaseFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) != 1 {
+		return nil, errors.New("xpath: upper-case function must have one parameter")
+	}
+	arg, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: upperCaseFunc(arg)}, nil
+}
+
+// processStartsWithFunc builds the query of starts-with().
+func (b *builder) processStartsWithFunc(root *functionNode, props *builderProp) (query, error) {
+	arg1, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	arg2, err := b.processArgument(root.Args[1], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: startwithFunc(arg1, arg2)}, nil
+}
+
+// processEndsWithFunc builds the query of ends-with().
+func (b *builder) processEndsWithFunc(root *functionNode, props *builderProp) (query, error) {
+	arg1, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	arg2, err := b.processArgument(root.Args[1], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: endwithFunc(arg1, arg2)}, nil
+}
+
+// processContainsFunc builds the query of contains().
+func (b *builder) processContainsFunc(root *functionNode, props *builderProp) (query, error) {
+	arg1, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	arg2, err := b.processArgument(root.Args[1], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: containsFunc(arg1, arg2)}, nil
+}
+
+// processMatchesFunc builds the query of matches().
+func (b *builder) processMatchesFunc(root *functionNode, props *builderProp) (query, error) {
+	//matches(string , pattern)
+	if len(root.Args) != 2 {
+		return nil, errors.New("xpath: matches function must have two parameters")
+	}
+	var (
+		arg1, arg2 query
+		err        error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	// Issue #92, testing the regular expression before.
+	if q, ok := arg2.(*constantQuery); ok {
+		if _, err = getRegexp(q.Val.(string)); err != nil {
+			return nil, fmt.Errorf("matches() got error. %v", err)
 		}
-		qyOutput = &functionQuery{Func: containsFunc(arg1, arg2)}
-	case "matches":
-		//matches(string , pattern)
-		if len(root.Args) != 2 {
-			return nil, errors.New("xpath: matches function must have two parameters")
-		}
-		var (
-			arg1, arg2 query
-			err        error
-		)
-		if arg1, err = b.processNode(root.Args[0], flagsEnum.None, props); err != nil {
+	}
+	return &functionQuery{Func: matchesFunc(arg1, arg2)}, nil
+}
+
+// processSubstringFunc builds the query of substring().
+func (b *builder) processSubstringFunc(root *functionNode, props *builderProp) (query, error) {
+	//substring( string , start [, length] )
+	if len(root.Args) < 2 {
+		return nil, errors.New("xpath: substring function must have at least two parameter")
+	}
+	var (
+		arg1, arg2, arg3 query
+		err              error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	if len(root.Args) == 3 {
+		if arg3, err = b.processArgument(root.Args[2], props); err != nil {
 			return nil, err
 		}
-		if arg2, err = b.processNode(root.Args[1], flagsEnum.None, props); err != nil {
+	}
+	return &functionQuery{Func: substringFunc(arg1, arg2, arg3)}, nil
+}
+
+// processSubstringBeforeAfterFunc builds the query of substring-before(), substring-after().
+func (b *builder) processSubstringBeforeAfterFunc(root *functionNode, props *builderProp) (query, error) {
+	//substring-xxxx( haystack, needle )
+	if len(root.Args) != 2 {
+		return nil, errors.New("xpath: substring-before function must have two parameters")
+	}
+	var (
+		arg1, arg2 query
+		err        error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	return &functionQuery{
+		Func: substringIndFunc(arg1, arg2, root.FuncName == "substring-after"),
+	}, nil
+}
+
+// processStringLengthFunc builds the query of string-length().
+func (b *builder) processStringLengthFunc(root *functionNode, props *builderProp) (query, error) {
+	// string-length( [string] )
+	if len(root.Args) < 1 {
+		return nil, errors.New("xpath: string-length function must have at least one parameter")
+	}
+	arg1, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: stringLengthFunc(arg1)}, nil
+}
+
+// processNormalizeSpaceFunc builds the query of normalize-space().
+func (b *builder) processNormalizeSpaceFunc(root *functionNode, props *builderProp) (query, error) {
+	var arg node
+	if len(root.Args) > 0 {
+		arg = root.Args[0]
+	} else {
+		arg = newAxisNode("self", allNode, "", "", "", nil)
+	}
+	arg1, err := b.processArgument(arg, props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: normalizespaceFunc(arg1)}, nil
+}
+
+// processReplaceFunc builds the query of replace().
+func (b *builder) processReplaceFunc(root *functionNode, props *builderProp) (query, error) {
+	//replace( string , string, string )
+	if len(root.Args) != 3 {
+		return nil, errors.New("xpath: replace function must have three parameters")
+	}
+	var (
+		arg1, arg2, arg3 query
+		err              error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	if arg3, err = b.processArgument(root.Args[2], props); err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: replaceFunc(arg1, arg2, arg3)}, nil
+}
+
+// processTranslateFunc builds the query of translate().
+func (b *builder) processTranslateFunc(root *functionNode, props *builderProp) (query, error) {
+	//translate( string , string, string )
+	if len(root.Args) != 3 {
+		return nil, errors.New("xpath: translate function must have three parameters")
+	}
+	var (
+		arg1, arg2, arg3 query
+		err              error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	if arg3, err = b.processArgument(root.Args[2], props); err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: translateFunc(arg1, arg2, arg3)}, nil
+}
+
+// processIDFunc builds the query of id().
+func (b *builder) processIDFunc(root *functionNode, props *builderProp) (query, error) {
+	//id( object )
+	if len(root.Args) != 1 {
+		return nil, errors.New("xpath: id function must have one parameter")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &transformFunctionQuery{Input: argQuery, Func: idFunc(b.idAttrs)}, nil
+}
+
+// processFormatNumberFunc builds the query of format-number().
+func (b *builder) processFormatNumberFunc(root *functionNode, props *builderProp) (query, error) {
+	//format-number( number, string [, string] )
+	if len(root.Args) < 2 || len(root.Args) > 3 {
+		return nil, errors.New("xpath: format-number function must have two or three parameters")
+	}
+	var (
+		arg1, arg2, arg3 query
+		err              error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	format := defaultDecimalFormat
+	if f, ok := b.formats[""]; ok {
+		format = f
+	}
+	if len(root.Args) == 3 {
+		if arg3, err = b.processArgument(root.Args[2], props); err != nil {
 			return nil, err
 		}
-		// Issue #92, testing the regular expression before.
-		if q, ok := arg2.(*constantQuery); ok {
-			if _, err = getRegexp(q.Val.(string)); err != nil {
-				return nil, fmt.Errorf("matches() got error. %v", err)
+		if q, ok := arg3.(*constantQuery); ok {
+			if name, ok := q.Val.(string); ok {
+				if format, err = lookupDecimalFormat(b.formats, name); err != nil {
+					return nil, err
+				}
 			}
 		}
-		qyOutput = &functionQuery{Func: matchesFunc(arg1, arg2)}
-	case "substring":
-		//substring( string , start [, length] )
-		if len(root.Args) < 2 {
-			return nil, errors.New("xpath: substring function must have at least two parameter")
-		}
-		var (
-			arg1, arg2, arg3 query
-			err              error
-		)
-		if arg1, err = b.processNode(root.Args[0], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if arg2, err = b.processNode(root.Args[1], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if len(root.Args) == 3 {
-			if arg3, err = b.processNode(root.Args[2], flagsEnum.None, props); err != nil {
+	}
+	// Check a literal picture string before evaluating.
+	if q, ok := arg2.(*constantQuery); ok {
+		if picture, ok := q.Val.(string); ok {
+			if _, err = parsePicture(picture, format); err != nil {
 				return nil, err
 			}
 		}
-		qyOutput = &functionQuery{Func: substringFunc(arg1, arg2, arg3)}
-	case "substring-before", "substring-after":
-		//substring-xxxx( haystack, needle )
-		if len(root.Args) != 2 {
-			return nil, errors.New("xpath: substring-before function must have two parameters")
-		}
-		var (
-			arg1, arg2 query
-			err        error
-		)
-		if arg1, err = b.processNode(root.Args[0], flagsEnum.None, props); err != nil {
-			return nil, err
+	}
+	return &functionQuery{Func: formatNumberFunc(arg1, arg2, arg3, b.formats)}, nil
+}
+
+// processKeyFunc builds the query of key().
+func (b *builder) processKeyFunc(root *functionNode, props *builderProp) (query, error) {
+	//key( string, object )
+	if len(root.Args) != 2 {
+		return nil, errors.New("xpath: key function must have two parameters")
+	}
+	var (
+		arg1, arg2 query
+		err        error
+	)
+	if arg1, err = b.processArgument(root.Args[0], props); err != nil {
+		return nil, err
+	}
+	if arg2, err = b.processArgument(root.Args[1], props); err != nil {
+		return nil, err
+	}
+	// A literal key name compiles only this key.
+	names := make([]string, 0, len(b.keys))
+	if q, ok := arg1.(*constantQuery); ok {
+		name := asString(nil, q.Val)
+		if _, ok := b.keys[name]; !ok {
+			return nil, fmt.Errorf("xpath: key %s is not defined", name)
+		}
+		names = append(names, name)
+	} else {
+		for name := range b.keys {
+			names = append(names, name)
 		}
-		if arg2, err = b.processNode(root.Args[1], flagsEnum.None, props); err != nil {
+	}
+	keys := make(map[string]*keyIndex, len(names))
+	for _, name := range names {
+		if keys[name], err = b.compileKey(name, b.keys[name]); err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{
-			Func: substringIndFunc(arg1, arg2, root.FuncName == "substring-after"),
-		}
-	case "string-length":
-		// string-length( [string] )
-		if len(root.Args) < 1 {
-			return nil, errors.New("xpath: string-length function must have at least one parameter")
-		}
-		arg1, err := b.processNode(root.Args[0], flagsEnum.None, props)
+	}
+	return &transformFunctionQuery{Input: arg2, Func: keyFunc(arg1, keys)}, nil
+}
+
+// processXSLTFunc builds the query of function-available(), element-available(), system-property().
+func (b *builder) processXSLTFunc(root *functionNode, props *builderProp) (query, error) {
+	var qyOutput query
+	if len(root.Args) != 1 {
+		return nil, fmt.Errorf("xpath: %s function must have one parameter", root.FuncName)
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	switch root.FuncName {
+	case "function-available":
+		fb := &builder{namespaces: b.namespaces, functions: b.functions}
+		qyOutput = &functionQuery{Func: functionAvailableFunc(argQuery, fb.functionAvailable)}
+	case "element-available":
+		qyOutput = &functionQuery{Func: elementAvailableFunc(argQuery)}
+	case "system-property":
+		qyOutput = &functionQuery{Func: systemPropertyFunc(argQuery, b.namespaces)}
+	}
+	return qyOutput, nil
+}
+
+// processLangFunc builds the query of lang().
+func (b *builder) processLangFunc(root *functionNode, props *builderProp) (query, error) {
+	//lang( string )
+	if len(root.Args) != 1 {
+		return nil, errors.New("xpath: lang function must have one parameter")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: langFunc(argQuery)}, nil
+}
+
+// processNotFunc builds the query of not().
+func (b *builder) processNotFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) == 0 {
+		return nil, errors.New("xpath: not function must have at least one parameter")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: notFunc(argQuery)}, nil
+}
+
+// processNameFunc builds the query of name(), local-name(), namespace-uri(), generate-id().
+func (b *builder) processNameFunc(root *functionNode, props *builderProp) (query, error) {
+	var qyOutput query
+	if len(root.Args) > 1 {
+		return nil, fmt.Errorf("xpath: %s function must have at most one parameter", root.FuncName)
+	}
+	var (
+		arg query
+		err error
+	)
+	if len(root.Args) == 1 {
+		arg, err = b.processArgument(root.Args[0], props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: stringLengthFunc(arg1)}
-	case "normalize-space":
-		var arg node
-		if len(root.Args) > 0 {
-			arg = root.Args[0]
-		} else {
-			arg = newAxisNode("self", allNode, "", "", "", nil)
-		}
-		arg1, err := b.processNode(arg, flagsEnum.None, props)
+	} else if b.atomic {
+		// The context item must be a node.
+		arg, err = b.processArgument(newAxisNode("self", allNode, "", "", "", nil), props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: normalizespaceFunc(arg1)}
-	case "replace":
-		//replace( string , string, string )
-		if len(root.Args) != 3 {
-			return nil, errors.New("xpath: replace function must have three parameters")
-		}
-		var (
-			arg1, arg2, arg3 query
-			err              error
-		)
-		if arg1, err = b.processNode(root.Args[0], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if arg2, err = b.processNode(root.Args[1], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if arg3, err = b.processNode(root.Args[2], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		qyOutput = &functionQuery{Func: replaceFunc(arg1, arg2, arg3)}
-	case "translate":
-		//translate( string , string, string )
-		if len(root.Args) != 3 {
-			return nil, errors.New("xpath: translate function must have three parameters")
-		}
-		var (
-			arg1, arg2, arg3 query
-			err              error
-		)
-		if arg1, err = b.processNode(root.Args[0], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if arg2, err = b.processNode(root.Args[1], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		if arg3, err = b.processNode(root.Args[2], flagsEnum.None, props); err != nil {
-			return nil, err
-		}
-		qyOutput = &functionQuery{Func: translateFunc(arg1, arg2, arg3)}
-	case "not":
-		if len(root.Args) == 0 {
-			return nil, errors.New("xpath: not function must have at least one parameter")
-		}
-		argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
+	}
+	switch root.FuncName {
+	case "name":
+		qyOutput = &functionQuery{Func: nameFunc(arg)}
+	case "local-name":
+		qyOutput = &functionQuery{Func: localNameFunc(arg)}
+	case "namespace-uri":
+		qyOutput = &functionQuery{Func: namespaceFunc(arg)}
+	case "generate-id":
+		qyOutput = &functionQuery{Func: generateIDFunc(arg)}
+	}
+	return qyOutput, nil
+}
+
+// processTrueFalseFunc builds the query of true(), false().
+func (b *builder) processTrueFalseFunc(root *functionNode, props *builderProp) (query, error) {
+	val := root.FuncName == "true"
+	return &functionQuery{
+		Func: func(_ query, _ iterator) interface{} {
+			return val
+		},
+	}, nil
+}
+
+// processLastFunc builds the query of last().
+func (b *builder) processLastFunc(root *functionNode, props *builderProp) (query, error) {
+	*props |= builderProps.HasLast
+	return &functionQuery{Input: b.firstInput, Func: lastFunc()}, nil
+}
+
+// processPositionFunc builds the query of position().
+func (b *builder) processPositionFunc(root *functionNode, props *builderProp) (query, error) {
+	*props |= builderProps.HasPosition
+	return &functionQuery{Input: b.firstInput, Func: positionFunc()}, nil
+}
+
+// processConversionFunc builds the query of boolean(), number(), string().
+func (b *builder) processConversionFunc(root *functionNode, props *builderProp) (query, error) {
+	var qyOutput query
+	var inp query
+	if len(root.Args) > 1 {
+		return nil, fmt.Errorf("xpath: %s function must have at most one parameter", root.FuncName)
+	}
+	if len(root.Args) == 1 {
+		argQuery, err := b.processArgument(root.Args[0], props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: notFunc(argQuery)}
-	case "name", "local-name", "namespace-uri":
-		if len(root.Args) > 1 {
-			return nil, fmt.Errorf("xpath: %s function must have at most one parameter", root.FuncName)
-		}
-		var (
-			arg query
-			err error
-		)
-		if len(root.Args) == 1 {
-			arg, err = b.processNode(root.Args[0], flagsEnum.None, props)
-			if err != nil {
-				return nil, err
-			}
-		}
-		switch root.FuncName {
-		case "name":
-			qyOutput = &functionQuery{Func: nameFunc(arg)}
-		case "local-name":
-			qyOutput = &functionQuery{Func: localNameFunc(arg)}
-		case "namespace-uri":
-			qyOutput = &functionQuery{Func: namespaceFunc(arg)}
-		}
-	case "true", "false":
-		val := root.FuncName == "true"
-		qyOutput = &functionQuery{
-			Func: func(_ query, _ iterator) interface{} {
-				return val
-			},
-		}
-	case "last":
-		qyOutput = &functionQuery{Input: b.firstInput, Func: lastFunc()}
-		*props |= builderProps.HasLast
-	case "position":
-		qyOutput = &functionQuery{Input: b.firstInput, Func: positionFunc()}
-		*props |= builderProps.HasPosition
-	case "boolean", "number", "string":
-		var inp query
-		if len(root.Args) > 1 {
-			return nil, fmt.Errorf("xpath: %s function must have at most one parameter", root.FuncName)
-		}
-		if len(root.Args) == 1 {
-			argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
-			if err != nil {
-				return nil, err
-			}
-			inp = argQuery
-		}
-		switch root.FuncName {
-		case "boolean":
-			qyOutput = &functionQuery{Func: booleanFunc(inp)}
-		case "string":
-			qyOutput = &functionQuery{Func: stringFunc(inp)}
-		case "number":
-			qyOutput = &functionQuery{Func: numberFunc(inp)}
-		}
-	case "count":
-		if len(root.Args) == 0 {
-			return nil, fmt.Errorf("xpath: count(node-sets) function must with have parameters node-sets")
-		}
-		argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
+		inp = argQuery
+	} else if b.atomic && root.FuncName != "boolean" {
+		// string() and number() take the context item, which may be atomic.
+		argQuery, err := b.processArgument(newAxisNode("self", allNode, "", "", "", nil), props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: countFunc(argQuery)}
-	case "sum":
-		if len(root.Args) == 0 {
-			return nil, fmt.Errorf("xpath: sum(node-sets) function must with have parameters node-sets")
-		}
-		argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
+		inp = argQuery
+	}
+	switch root.FuncName {
+	case "boolean":
+		qyOutput = &functionQuery{Func: booleanFunc(inp)}
+	case "string":
+		qyOutput = &functionQuery{Func: stringFunc(inp)}
+	case "number":
+		qyOutput = &functionQuery{Func: numberFunc(inp)}
+	}
+	return qyOutput, nil
+}
+
+// processCountFunc builds the query of count().
+func (b *builder) processCountFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) == 0 {
+		return nil, fmt.Errorf("xpath: count(node-sets) function must with have parameters node-sets")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: countFunc(argQuery)}, nil
+}
+
+// processSumFunc builds the query of sum().
+func (b *builder) processSumFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) == 0 {
+		return nil, fmt.Errorf("xpath: sum(node-sets) function must with have parameters node-sets")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: sumFunc(argQuery)}, nil
+}
+
+// processRoundingFunc builds the query of ceiling(), floor(), round().
+func (b *builder) processRoundingFunc(root *functionNode, props *builderProp) (query, error) {
+	var qyOutput query
+	if len(root.Args) == 0 {
+		return nil, fmt.Errorf("xpath: ceiling(node-sets) function must with have parameters node-sets")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	switch root.FuncName {
+	case "ceiling":
+		qyOutput = &functionQuery{Func: ceilingFunc(argQuery)}
+	case "floor":
+		qyOutput = &functionQuery{Func: floorFunc(argQuery)}
+	case "round":
+		qyOutput = &functionQuery{Func: roundFunc(argQuery)}
+	}
+	return qyOutput, nil
+}
+
+// processConcatFunc builds the query of concat().
+func (b *builder) processConcatFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) < 2 {
+		return nil, fmt.Errorf("xpath: concat() must have at least two arguments")
+	}
+	var args []query
+	for _, v := range root.Args {
+		q, err := b.processArgument(v, props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: sumFunc(argQuery)}
-	case "ceiling", "floor", "round":
-		if len(root.Args) == 0 {
-			return nil, fmt.Errorf("xpath: ceiling(node-sets) function must with have parameters node-sets")
-		}
-		argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
+		args = append(args, q)
+	}
+	return &functionQuery{Func: concatFunc(args...)}, nil
+}
+
+// processReverseFunc builds the query of reverse().
+func (b *builder) processReverseFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) == 0 {
+		return nil, fmt.Errorf("xpath: reverse(node-sets) function must with have parameters node-sets")
+	}
+	argQuery, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &transformFunctionQuery{Input: argQuery, Func: reverseFunc}, nil
+}
+
+// processDistinctValuesFunc builds the query of distinct-values().
+func (b *builder) processDistinctValuesFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) != 1 {
+		return nil, fmt.Errorf("xpath: distinct-values(sequence) function must have one argument")
+	}
+	arg, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: distinctValuesFunc(arg)}, nil
+}
+
+// processStringJoinFunc builds the query of string-join().
+func (b *builder) processStringJoinFunc(root *functionNode, props *builderProp) (query, error) {
+	if len(root.Args) != 2 {
+		return nil, fmt.Errorf("xpath: string-join(node-sets, separator) function requires node-set and argument")
+	}
+	input, err := b.processArgument(root.Args[0], props)
+	if err != nil {
+		return nil, err
+	}
+	arg1, err := b.processArgument(root.Args[1], props)
+	if err != nil {
+		return nil, err
+	}
+	return &functionQuery{Func: stringJoinFunc(input, arg1)}, nil
+}
+
+// processArgument processes query for an argument of a function, which
+// gets the nodes of a node-set in document order.
+func (b *builder) processArgument(root node, props *builderProp) (query, error) {
+	q, err := b.processNode(root, flagsEnum.None, props)
+	if err != nil {
+		return nil, err
+	}
+	return inDocumentOrder(q), nil
+}
+
+// lookupFunction returns the custom function name in the namespace
+// namespaceURI, resolved by the builder's resolver or the registry.
+func (b *builder) lookupFunction(namespaceURI, name string) *Function {
+	if b.functions != nil {
+		if fn := b.functions.ResolveFunction(namespaceURI, name); fn != nil {
+			return fn
 		}
-		switch root.FuncName {
-		case "ceiling":
-			qyOutput = &functionQuery{Func: ceilingFunc(argQuery)}
-		case "floor":
-			qyOutput = &functionQuery{Func: floorFunc(argQuery)}
-		case "round":
-			qyOutput = &functionQuery{Func: roundFunc(argQuery)}
-		}
-	case "concat":
-		if len(root.Args) < 2 {
-			return nil, fmt.Errorf("xpath: concat() must have at least two arguments")
-		}
-		var args []query
-		for _, v := range root.Args {
-			q, err := b.processNode(v, flagsEnum.None, props)
-			if err != nil {
-				return nil, err
+	}
+	return lookupFunction(namespaceURI, name)
+}
+
+// functionAvailable reports whether the function name, given as a QName,
+// can be called by an expression.
+func (b *builder) functionAvailable(name string) bool {
+	prefix, local := splitQName(name)
+	if prefix != "" {
+		ns, ok := b.namespaces[prefix]
+		return ok && b.lookupFunction(ns, local) != nil
+	}
+	if _, ok := builtinFunctions[local]; ok {
+		return true
+	}
+	return b.lookupFunction("", local) != nil
+}
+
+// checkStrict rejects in strict mode a call to a function that is not part
+// of the XPath 1.0 core function library, except a custom function when
+// they are allowed.
+func (b *builder) checkStrict(root *functionNode) error {
+	if !b.strict || (root.Prefix == "" && xpath1Functions[root.FuncName]) {
+		return nil
+	}
+	if b.custom {
+		if root.Prefix != "" {
+			if ns, ok := b.namespaces[root.Prefix]; ok && b.lookupFunction(ns, root.FuncName) != nil {
+				return nil
 			}
-			args = append(args, q)
-		}
-		qyOutput = &functionQuery{Func: concatFunc(args...)}
-	case "reverse":
-		if len(root.Args) == 0 {
-			return nil, fmt.Errorf("xpath: reverse(node-sets) function must with have parameters node-sets")
-		}
-		argQuery, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
-		}
-		qyOutput = &transformFunctionQuery{Input: argQuery, Func: reverseFunc}
-	case "string-join":
-		if len(root.Args) != 2 {
-			return nil, fmt.Errorf("xpath: string-join(node-sets, separator) function requires node-set and argument")
-		}
-		input, err := b.processNode(root.Args[0], flagsEnum.None, props)
-		if err != nil {
-			return nil, err
+		} else if _, ok := builtinFunctions[root.FuncName]; !ok && b.lookupFunction("", root.FuncName) != nil {
+			return nil
 		}
-		arg1, err := b.processNode(root.Args[1], flagsEnum.None, props)
+	}
+	name := root.FuncName
+	if root.Prefix != "" {
+		name = root.Prefix + ":" + name
+	}
+	return fmt.Errorf("xpath: %s() is not an XPath 1.0 function", name)
+}
+
+// processCustomFunction processes query for a function registered by RegisterFunction.
+func (b *builder) processCustomFunction(root *functionNode, fn *Function, props *builderProp) (query, error) {
+	name := root.FuncName
+	if root.Prefix != "" {
+		name = root.Prefix + ":" + name
+	}
+	if err := fn.checkArgs(name, len(root.Args)); err != nil {
+		return nil, err
+	}
+	args := make([]query, len(root.Args))
+	for i, v := range root.Args {
+		q, err := b.processArgument(v, props)
 		if err != nil {
 			return nil, err
 		}
-		qyOutput = &functionQuery{Func: stringJoinFunc(input, arg1)}
-	default:
-		return nil, fmt.Errorf("not yet support this function %s()", root.FuncName)
+		args[i] = q
 	}
-	return qyOutput, nil
+	return &customFunctionQuery{Name: name, Func: fn, Args: args}, nil
 }
 
 func (b *builder) processOperator(root *operatorNode, props *builderProp) (query, error) {
@@ -610,7 +1050,10 @@ func (b *builder) processOperator(root *operatorNode, props *builderProp) (query
 	if err != nil {
 		return nil, err
 	}
+	atomic := b.atomic
+	b.atomic = atomic || root.Op == "!"
 	right, err := b.processNode(root.Right, flagsEnum.None, &rightProp)
+	b.atomic = atomic
 	if err != nil {
 		return nil, err
 	}
@@ -649,7 +1092,33 @@ func (b *builder) processOperator(root *operatorNode, props *builderProp) (query
 		case "!=":
 			exprFunc = neFunc
 		}
-		qyOutput = &logicalQuery{Left: left, Right: right, Do: exprFunc}
+		// A range is compared by its bounds rather than built.
+		if r, ok := right.(*rangeQuery); ok {
+			qyOutput = &rangeCompareQuery{Op: root.Op, Value: left, Range: r}
+		} else if r, ok := left.(*rangeQuery); ok {
+			qyOutput = &rangeCompareQuery{Op: reverseOp(root.Op), Value: right, Range: r}
+		} else {
+			qyOutput = &logicalQuery{Left: left, Right: right, Do: exprFunc}
+		}
+	case "eq", "ne", "lt", "le", "gt", "ge":
+		var op string
+		switch root.Op {
+		case "eq":
+			op = "="
+		case "ne":
+			op = "!="
+		case "lt":
+			op = "<"
+		case "le":
+			op = "<="
+		case "gt":
+			op = ">"
+		case "ge":
+			op = ">="
+		}
+		qyOutput = &valueCompareQuery{Op: op, Left: left, Right: right}
+	case "is", "<<", ">>":
+		qyOutput = &nodeCompareQuery{Op: root.Op, Left: left, Right: right}
 	case "or", "and":
 		isOr := false
 		if root.Op == "or" {
@@ -659,12 +1128,98 @@ func (b *builder) processOperator(root *operatorNode, props *builderProp) (query
 	case "|":
 		*props |= builderProps.NonFlat
 		qyOutput = &unionQuery{Left: left, Right: right}
+	case "to":
+		qyOutput = &rangeQuery{Left: left, Right: right}
+	case "!":
+		qyOutput = &mapQuery{Left: inDocumentOrder(left), Right: inDocumentOrder(right)}
+	case "intersect", "except":
+		*props |= builderProps.NonFlat
+		qyOutput = &intersectQuery{Left: left, Right: right, Except: root.Op == "except"}
 	}
 	return qyOutput, nil
 }
 
+// processIf processes query for the XPath conditional expression node.
+func (b *builder) processIf(root *ifNode, props *builderProp) (query, error) {
+	var condProp, thenProp, elseProp builderProp
+	cond, err := b.processNode(root.Cond, flagsEnum.None, &condProp)
+	if err != nil {
+		return nil, err
+	}
+	then, err := b.processNode(root.Then, flagsEnum.None, &thenProp)
+	if err != nil {
+		return nil, err
+	}
+	els, err := b.processNode(root.Else, flagsEnum.None, &elseProp)
+	if err != nil {
+		return nil, err
+	}
+	*props = condProp | thenProp | elseProp
+	return &ifQuery{Cond: cond, Then: inDocumentOrder(then), Else: inDocumentOrder(els)}, nil
+}
+
+// processFor processes query for the XPath for expression node.
+func (b *builder) processFor(root *forNode, props *builderProp) (query, error) {
+	var inProp, retProp builderProp
+	in, err := b.processNode(root.In, flagsEnum.None, &inProp)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := b.processInScope(root.Name, root.Return, &retProp)
+	if err != nil {
+		return nil, err
+	}
+	*props = inProp | retProp
+	return &forQuery{Name: root.Name, In: inDocumentOrder(in), Return: inDocumentOrder(ret)}, nil
+}
+
+// processQuantified processes query for the XPath some or every expression
+// node.
+func (b *builder) processQuantified(root *quantifiedNode, props *builderProp) (query, error) {
+	var inProp, condProp builderProp
+	in, err := b.processNode(root.In, flagsEnum.None, &inProp)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := b.processInScope(root.Name, root.Satisfies, &condProp)
+	if err != nil {
+		return nil, err
+	}
+	*props = inProp | condProp
+	return &quantifiedQuery{Every: root.Every, Name: root.Name, In: in, Satisfies: cond}, nil
+}
+
+// processLet processes query for the XPath let expression node.
+func (b *builder) processLet(root *letNode, props *builderProp) (query, error) {
+	var valueProp, retProp builderProp
+	value, err := b.processNode(root.Value, flagsEnum.None, &valueProp)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := b.processInScope(root.Name, root.Return, &retProp)
+	if err != nil {
+		return nil, err
+	}
+	*props = valueProp | retProp
+	return &letQuery{Name: root.Name, Value: inDocumentOrder(value), Return: inDocumentOrder(ret)}, nil
+}
+
+// processInScope processes the node n with the variable name declared, for
+// the expression in the scope of a variable binding.
+func (b *builder) processInScope(name string, n node, props *builderProp) (query, error) {
+	declared := b.variables[name]
+	b.variables[name] = true
+	b.scoped[name]++
+	q, err := b.processNode(n, flagsEnum.None, props)
+	b.scoped[name]--
+	if !declared {
+		delete(b.variables, name)
+	}
+	return q, err
+}
+
 func (b *builder) processNode(root node, flags flag, props *builderProp) (q query, err error) {
-	if b.parseDepth = b.parseDepth + 1; b.parseDepth > 1024 {
+	if b.parseDepth = b.parseDepth + 1; b.parseDepth > b.maxDepth {
 		err = errors.New("the xpath expressions is too complex")
 		return
 	}
@@ -690,42 +1245,108 @@ func (b *builder) processNode(root node, flags flag, props *builderProp) (q quer
 		if err != nil {
 			return
 		}
-		q = &groupQuery{Input: q}
+		q = &groupQuery{Input: inDocumentOrder(q)}
+		b.firstInput = q
+	case nodeSequence:
+		items := root.(*sequenceNode).Items
+		s := &sequenceQuery{Items: make([]query, len(items))}
+		for i, item := range items {
+			var itemProps builderProp
+			if s.Items[i], err = b.processNode(item, flagsEnum.None, &itemProps); err != nil {
+				break
+			}
+			s.Items[i] = inDocumentOrder(s.Items[i])
+			*props |= itemProps
+		}
+		q = s
+		b.firstInput = q
+	case nodeIf:
+		q, err = b.processIf(root.(*ifNode), props)
+		b.firstInput = q
+	case nodeFor:
+		q, err = b.processFor(root.(*forNode), props)
+		b.firstInput = q
+	case nodeQuantified:
+		q, err = b.processQuantified(root.(*quantifiedNode), props)
+	case nodeLet:
+		q, err = b.processLet(root.(*letNode), props)
 		b.firstInput = q
 	case nodeVariable:
-		// Variables have no binding in a compiled expression, so they cannot
-		// resolve to a query. A bare "$x" already surfaces as an undeclared
-		// variable error because the nil result reaches the caller, but a
-		// variable nested in a larger expression (e.g. "$x/@attr") would be
-		// swallowed here and left as a nil sub-query that panics at select
-		// time. Report it as undeclared instead.
+		// Only declared variables have a value at evaluation time. A variable
+		// nested in a larger expression (e.g. "$x/@attr") must be reported
+		// here, otherwise it leaves a nil sub-query that panics at select time.
 		n := root.(*variableNode)
 		name := n.Name
 		if n.Prefix != "" {
 			name = n.Prefix + ":" + name
 		}
-		err = fmt.Errorf("undeclared variable in XPath expression: $%s", name)
+		if !b.variables[name] {
+			err = fmt.Errorf("undeclared variable in XPath expression: $%s", name)
+			break
+		}
+		if b.scoped[name] == 0 {
+			b.free[name] = true
+		}
+		q = &variableQuery{Name: name}
+		b.firstInput = q
 	}
 	b.parseDepth--
 	return
 }
 
-// build builds a specified XPath expressions expr.
-func build(expr string, namespaces map[string]string) (q query, err error) {
+// build builds a specified XPath expressions expr. It also returns the
+// names of the variables whose values must be passed to the evaluation.
+func build(expr string, opts *Options) (q query, vars []string, err error) {
 	defer func() {
 		if e := recover(); e != nil {
-			switch x := e.(type) {
-			case string:
-				err = errors.New(x)
-			case error:
-				err = x
-			default:
-				err = errors.New("unknown panic")
-			}
+			err = panicError(e)
 		}
 	}()
-	root := parse(expr, namespaces)
-	b := &builder{}
+	if opts == nil {
+		opts = &Options{}
+	}
+	root := parse(expr, opts.Namespaces, opts.Strict)
+	b := &builder{
+		variables:  make(map[string]bool, len(opts.Variables)),
+		scoped:     make(map[string]int),
+		free:       make(map[string]bool),
+		namespaces: opts.Namespaces,
+		functions:  opts.Functions,
+		strict:     opts.Strict,
+		maxDepth:   opts.Limits.MaxDepth,
+		custom:     opts.StrictCustomFunctions,
+		idAttrs:    opts.IDAttributes,
+		formats:    opts.DecimalFormats,
+		keys:       opts.Keys,
+	}
+	if b.maxDepth <= 0 {
+		b.maxDepth = defaultMaxDepth
+	}
+	if len(b.idAttrs) == 0 {
+		b.idAttrs = defaultIDAttributes
+	}
+	for name := range opts.Variables {
+		b.variables[name] = true
+	}
 	props := builderProps.None
-	return b.processNode(root, flagsEnum.None, &props)
+	if q, err = b.processNode(root, flagsEnum.None, &props); err != nil {
+		return nil, nil, err
+	}
+	for name := range b.free {
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+	return inDocumentOrder(q), vars, nil
+}
+
+// panicError converts the value recovered from a panic to an error.
+func panicError(e interface{}) error {
+	switch x := e.(type) {
+	case string:
+		return errors.New(x)
+	case error:
+		return x
+	default:
+		return errors.New("unknown panic")
+	}
 }
@@ -0,0 +1,190 @@
+package xpath
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ValueType is the type of a custom function argument or result.
+type ValueType int
+
+const (
+	// AnyType accepts a value of any type. A node-set is passed as
+	// []NodeNavigator, and a sequence that holds atomic values as a Sequence.
+	AnyType ValueType = iota
+
+	// StringType is a string, converted as by the string() function.
+	StringType
+
+	// NumberType is a float64, converted as by the number() function.
+	NumberType
+
+	// BooleanType is a bool, converted as by the boolean() function.
+	BooleanType
+
+	// NodeSetType is a node-set, passed as []NodeNavigator.
+	NodeSetType
+)
+
+// Function is a custom XPath function, which can be called from any
+// expression once registered by RegisterFunction.
+type Function struct {
+	// MinArgs is the minimum number of arguments.
+	MinArgs int
+
+	// MaxArgs is the maximum number of arguments, or -1 for no limit.
+	MaxArgs int
+
+	// Args is the type of each argument. The last type is also used for any
+	// further arguments; an argument without a type is AnyType.
+	Args []ValueType
+
+	// Returns is the type of the result.
+	Returns ValueType
+
+	// Call is called with the context node and the converted arguments. The
+	// result must be a string, float64, bool, []NodeNavigator or Sequence.
+	Call func(ctx NodeNavigator, args []interface{}) (interface{}, error)
+}
+
+var functions = struct {
+	sync.RWMutex
+	m map[string]*Function
+}{m: make(map[string]*Function)}
+
+func functionKey(namespaceURI, name string) string {
+	return "{" + namespaceURI + "}" + name
+}
+
+// RegisterFunction registers fn as the function name in the namespace
+// namespaceURI, replacing any function registered before under this name.
+// In an expression the function is called with a prefix bound to
+// namespaceURI by CompileWithNS, e.g. ext:slugify(), or without a prefix if
+// namespaceURI is empty. Built-in functions take precedence over unprefixed
+// custom functions.
+func RegisterFunction(namespaceURI, name string, fn *Function) error {
+	if name == "" {
+		return errors.New("xpath: function name is empty")
+	}
+	if fn == nil || fn.Call == nil {
+		return fmt.Errorf("xpath: function %s has no Call", name)
+	}
+	if fn.MinArgs < 0 || (fn.MaxArgs >= 0 && fn.MaxArgs < fn.MinArgs) {
+		return fmt.Errorf("xpath: function %s has an invalid number of arguments", name)
+	}
+	functions.Lock()
+	functions.m[functionKey(namespaceURI, name)] = fn
+	functions.Unlock()
+	return nil
+}
+
+// UnregisterFunction removes the function registered under name in the
+// namespace namespaceURI.
+func UnregisterFunction(namespaceURI, name string) {
+	functions.Lock()
+	delete(functions.m, functionKey(namespaceURI, name))
+	functions.Unlock()
+}
+
+func lookupFunction(namespaceURI, name string) *Function {
+	functions.RLock()
+	defer functions.RUnlock()
+	return functions.m[functionKey(namespaceURI, name)]
+}
+
+// argType returns the declared type of the i-th argument.
+func (fn *Function) argType(i int) ValueType {
+	if len(fn.Args) == 0 {
+		return AnyType
+	}
+	if i >= len(fn.Args) {
+		i = len(fn.Args) - 1
+	}
+	return fn.Args[i]
+}
+
+// checkArgs reports whether n arguments match the declared arity.
+func (fn *Function) checkArgs(name string, n int) error {
+	if n < fn.MinArgs || (fn.MaxArgs >= 0 && n > fn.MaxArgs) {
+		switch {
+		case fn.MaxArgs == fn.MinArgs:
+			return fmt.Errorf("xpath: %s() must have %d arguments", name, fn.MinArgs)
+		case fn.MaxArgs < 0:
+			return fmt.Errorf("xpath: %s() must have at least %d arguments", name, fn.MinArgs)
+		default:
+			return fmt.Errorf("xpath: %s() must have %d to %d arguments", name, fn.MinArgs, fn.MaxArgs)
+		}
+	}
+	return nil
+}
+
+// asNodeList returns all nodes of the node-set v.
+func asNodeList(t iterator, v interface{}) ([]NodeNavigator, bool) {
+	q, ok := v.(query)
+	if !ok {
+		return nil, false
+	}
+	var list []NodeNavigator
+	for node := q.Select(t); node != nil; node = q.Select(t) {
+		buffer(t)
+		list = append(list, node.Copy())
+	}
+	return list, true
+}
+
+// convertArg converts the evaluated argument v to the type typ.
+func convertArg(t iterator, name string, typ ValueType, v interface{}) interface{} {
+	switch typ {
+	case StringType:
+		return asString(t, v)
+	case NumberType:
+		return asNumber(t, v)
+	case BooleanType:
+		return asBool(t, v)
+	case NodeSetType:
+		list, ok := asNodeList(t, v)
+		if !ok {
+			panic(fmt.Errorf("xpath: %s() function argument type must be a node-set", name))
+		}
+		return list
+	}
+	if list, ok := asNodeList(t, v); ok {
+		return list
+	}
+	return v
+}
+
+// convertResult checks the value v returned by a custom function.
+func convertResult(t iterator, name string, typ ValueType, v interface{}) interface{} {
+	switch v.(type) {
+	case string, float64, bool, []NodeNavigator:
+	case Sequence:
+		if typ != AnyType {
+			panic(fmt.Errorf("xpath: %s() returned a sequence", name))
+		}
+		return v
+	default:
+		panic(fmt.Errorf("xpath: %s() returned an unsupported type %T", name, v))
+	}
+	if list, ok := v.([]NodeNavigator); ok {
+		if typ != AnyType && typ != NodeSetType {
+			panic(fmt.Errorf("xpath: %s() returned a node-set", name))
+		}
+		for range list {
+			buffer(t)
+		}
+		return list
+	}
+	switch typ {
+	case StringType:
+		return asString(t, v)
+	case NumberType:
+		return asNumber(t, v)
+	case BooleanType:
+		return asBool(t, v)
+	case NodeSetType:
+		panic(fmt.Errorf("xpath: %s() must return a node-set", name))
+	}
+	return v
+}
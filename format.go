@@ -0,0 +1,321 @@
+package xpath
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DecimalFormat holds the symbols used by format-number() to read a
+// picture string and write a number, like xsl:decimal-format. A zero field
+// means the default symbol.
+type DecimalFormat struct {
+	// DecimalSeparator separates the integer and fractional parts. The
+	// default is '.'.
+	DecimalSeparator rune
+
+	// GroupingSeparator separates the groups of integer digits. The default
+	// is ','.
+	GroupingSeparator rune
+
+	// Percent multiplies the number by 100. The default is '%'.
+	Percent rune
+
+	// PerMille multiplies the number by 1000. The default is '‰'.
+	PerMille rune
+
+	// ZeroDigit is the digit zero, and a mandatory digit in a picture. The
+	// default is '0'.
+	ZeroDigit rune
+
+	// Digit is an optional digit in a picture. The default is '#'.
+	Digit rune
+
+	// PatternSeparator separates the positive and negative subpictures.
+	// The default is ';'.
+	PatternSeparator rune
+
+	// MinusSign is the default prefix of a negative number. The default is
+	// '-'.
+	MinusSign rune
+
+	// Infinity is the string for infinity. The default is "Infinity".
+	Infinity string
+
+	// NaN is the string for NaN. The default is "NaN".
+	NaN string
+}
+
+var defaultDecimalFormat = &DecimalFormat{}
+
+// symbols returns f with the zero fields set to the default symbols.
+func (f *DecimalFormat) symbols() DecimalFormat {
+	d := *f
+	setRune := func(r *rune, v rune) {
+		if *r == 0 {
+			*r = v
+		}
+	}
+	setRune(&d.DecimalSeparator, '.')
+	setRune(&d.GroupingSeparator, ',')
+	setRune(&d.Percent, '%')
+	setRune(&d.PerMille, '‰')
+	setRune(&d.ZeroDigit, '0')
+	setRune(&d.Digit, '#')
+	setRune(&d.PatternSeparator, ';')
+	setRune(&d.MinusSign, '-')
+	if d.Infinity == "" {
+		d.Infinity = "Infinity"
+	}
+	if d.NaN == "" {
+		d.NaN = "NaN"
+	}
+	return d
+}
+
+// subPicture is a parsed positive or negative subpicture.
+type subPicture struct {
+	prefix, suffix string
+	multiplier     float64
+	minInt         int
+	minFrac        int
+	maxFrac        int
+	groups         []int // the positions of the grouping separators, counted from the decimal separator
+}
+
+// picture is a parsed format-number() picture string.
+type picture struct {
+	symbols  DecimalFormat
+	pos, neg subPicture
+	hasNeg   bool
+}
+
+// isDigit reports whether r is the digit sign or a digit of the zero digit
+// family.
+func (f *DecimalFormat) isDigit(r rune) bool {
+	return r == f.Digit || (r >= f.ZeroDigit && r <= f.ZeroDigit+9)
+}
+
+// parsePicture parses the picture string s using the symbols of f.
+func parsePicture(s string, f *DecimalFormat) (*picture, error) {
+	p := &picture{symbols: f.symbols()}
+	parts := strings.Split(s, string(p.symbols.PatternSeparator))
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("xpath: format-number() picture %q has more than two subpictures", s)
+	}
+	var err error
+	if p.pos, err = p.symbols.parseSubPicture(parts[0]); err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 {
+		if p.neg, err = p.symbols.parseSubPicture(parts[1]); err != nil {
+			return nil, err
+		}
+		p.hasNeg = true
+	}
+	return p, nil
+}
+
+func (f *DecimalFormat) parseSubPicture(s string) (subPicture, error) {
+	sub := subPicture{multiplier: 1}
+	runes := []rune(s)
+	active := func(r rune) bool {
+		return f.isDigit(r) || r == f.DecimalSeparator || r == f.GroupingSeparator
+	}
+	start, end := -1, -1
+	for i, r := range runes {
+		if active(r) {
+			if start < 0 {
+				start = i
+			}
+			end = i + 1
+		}
+	}
+	if start < 0 {
+		return sub, fmt.Errorf("xpath: format-number() picture %q has no digit", s)
+	}
+	sub.prefix, sub.suffix = string(runes[:start]), string(runes[end:])
+	for _, r := range sub.prefix + sub.suffix {
+		var m float64
+		switch r {
+		case f.Percent:
+			m = 100
+		case f.PerMille:
+			m = 1000
+		default:
+			continue
+		}
+		if sub.multiplier != 1 {
+			return sub, fmt.Errorf("xpath: format-number() picture %q has more than one percent or per-mille sign", s)
+		}
+		sub.multiplier = m
+	}
+
+	body := runes[start:end]
+	point := -1
+	for i, r := range body {
+		switch {
+		case r == f.DecimalSeparator:
+			if point >= 0 {
+				return sub, fmt.Errorf("xpath: format-number() picture %q has more than one decimal separator", s)
+			}
+			point = i
+		case !active(r):
+			return sub, fmt.Errorf("xpath: format-number() picture %q has a passive character between digits", s)
+		}
+	}
+	integer, fraction := body, []rune(nil)
+	if point >= 0 {
+		integer, fraction = body[:point], body[point+1:]
+	}
+
+	digits := 0
+	for i := len(integer) - 1; i >= 0; i-- {
+		switch r := integer[i]; {
+		case r == f.GroupingSeparator:
+			if i == 0 || i == len(integer)-1 || integer[i-1] == f.GroupingSeparator {
+				return sub, fmt.Errorf("xpath: format-number() picture %q has a misplaced grouping separator", s)
+			}
+			sub.groups = append(sub.groups, digits)
+		case r == f.Digit:
+			digits++
+		default:
+			digits++
+			sub.minInt++
+		}
+	}
+	for _, r := range fraction {
+		switch {
+		case r == f.GroupingSeparator:
+			return sub, fmt.Errorf("xpath: format-number() picture %q has a grouping separator in the fractional part", s)
+		case r == f.Digit:
+			sub.maxFrac++
+		default:
+			if sub.maxFrac > sub.minFrac {
+				return sub, fmt.Errorf("xpath: format-number() picture %q has a mandatory digit after an optional digit", s)
+			}
+			sub.minFrac++
+			sub.maxFrac++
+		}
+	}
+	if digits == 0 && sub.maxFrac == 0 {
+		return sub, fmt.Errorf("xpath: format-number() picture %q has no digit", s)
+	}
+	return sub, nil
+}
+
+// format formats the number v.
+func (p *picture) format(v float64) string {
+	f := &p.symbols
+	if math.IsNaN(v) {
+		return f.NaN
+	}
+	sub := p.pos
+	var prefix, suffix string
+	if v < 0 {
+		v = -v
+		if p.hasNeg {
+			sub = p.neg
+			prefix, suffix = sub.prefix, sub.suffix
+		} else {
+			prefix, suffix = string(f.MinusSign)+sub.prefix, sub.suffix
+		}
+	} else {
+		prefix, suffix = sub.prefix, sub.suffix
+	}
+	if math.IsInf(v, 0) {
+		return prefix + f.Infinity + suffix
+	}
+	v *= sub.multiplier
+
+	s := strconv.FormatFloat(v, 'f', sub.maxFrac, 64)
+	integer, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+	}
+	integer = strings.TrimLeft(integer, "0")
+	for len(integer) < sub.minInt {
+		integer = "0" + integer
+	}
+	for len(fraction) > sub.minFrac && fraction[len(fraction)-1] == '0' {
+		fraction = fraction[:len(fraction)-1]
+	}
+	if integer == "" && fraction == "" {
+		integer = "0"
+	}
+
+	b := builderPool.Get().(stringBuilder)
+	defer func() {
+		b.Reset()
+		builderPool.Put(b)
+	}()
+	b.WriteString(prefix)
+	for i, d := range integer {
+		b.WriteRune(f.ZeroDigit + (d - '0'))
+		if n := len(integer) - i - 1; n > 0 && sub.isGroupBoundary(n) {
+			b.WriteRune(f.GroupingSeparator)
+		}
+	}
+	if fraction != "" {
+		b.WriteRune(f.DecimalSeparator)
+		for _, d := range fraction {
+			b.WriteRune(f.ZeroDigit + (d - '0'))
+		}
+	}
+	b.WriteString(suffix)
+	return b.String()
+}
+
+// isGroupBoundary reports whether a grouping separator is written before
+// the last n integer digits. Groups of the same size repeat to the left.
+func (sub *subPicture) isGroupBoundary(n int) bool {
+	if len(sub.groups) == 0 {
+		return false
+	}
+	regular := sub.groups[0] > 0
+	for i, g := range sub.groups {
+		if g == n {
+			return true
+		}
+		if g != sub.groups[0]*(i+1) {
+			regular = false
+		}
+	}
+	return regular && n%sub.groups[0] == 0
+}
+
+// formatNumberFunc is XPATH functions format-number(number, string [, string])
+// function operation.
+func formatNumberFunc(arg1, arg2, arg3 query, formats map[string]*DecimalFormat) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		v := asNumber(t, functionArgs(arg1).Evaluate(t))
+		format := defaultDecimalFormat
+		if arg3 != nil {
+			name := asString(t, functionArgs(arg3).Evaluate(t))
+			var err error
+			if format, err = lookupDecimalFormat(formats, name); err != nil {
+				panic(err)
+			}
+		} else if f, ok := formats[""]; ok {
+			format = f
+		}
+		p, err := parsePicture(asString(t, functionArgs(arg2).Evaluate(t)), format)
+		if err != nil {
+			panic(err)
+		}
+		return checkString(t, p.format(v))
+	}
+}
+
+// lookupDecimalFormat returns the decimal format name of formats.
+func lookupDecimalFormat(formats map[string]*DecimalFormat, name string) (*DecimalFormat, error) {
+	if f, ok := formats[name]; ok {
+		return f, nil
+	}
+	if name == "" {
+		return defaultDecimalFormat, nil
+	}
+	return nil, errors.New("xpath: format-number() decimal format " + name + " is not defined")
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -79,6 +80,10 @@ func countFunc(arg query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
 		var count = 0
 		q := functionArgs(arg)
+		if r, ok := q.(*rangeQuery); ok {
+			it := r.iterate(t)
+			return math.Max(0, it.end-it.cursor+1)
+		}
 		test := predicate(q)
 		switch typ := q.Evaluate(t).(type) {
 		case query:
@@ -87,6 +92,8 @@ func countFunc(arg query) func(query, iterator) interface{} {
 					count++
 				}
 			}
+		case Sequence:
+			count = len(typ)
 		}
 		return float64(count)
 	}
@@ -96,16 +103,30 @@ func countFunc(arg query) func(query, iterator) interface{} {
 func sumFunc(arg query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
 		var sum float64
+		strict := isStrict(t)
 		switch typ := functionArgs(arg).Evaluate(t).(type) {
 		case query:
 			for node := typ.Select(t); node != nil; node = typ.Select(t) {
-				if v, err := strconv.ParseFloat(node.Value(), 64); err == nil {
+				if strict {
+					// A node that is not a number makes the sum NaN.
+					sum += xpath1Number(node.Value())
+				} else if v, err := strconv.ParseFloat(node.Value(), 64); err == nil {
 					sum += v
 				}
 			}
+		case Sequence:
+			for _, item := range typ {
+				sum += asNumber(t, item.atomize())
+			}
 		case float64:
+			if strict {
+				panic(errors.New("sum() function argument type must be a node-set"))
+			}
 			sum = typ
 		case string:
+			if strict {
+				panic(errors.New("sum() function argument type must be a node-set"))
+			}
 			v, err := strconv.ParseFloat(typ, 64)
 			if err != nil {
 				panic(errors.New("sum() function argument type must be a node-set or number"))
@@ -123,11 +144,16 @@ func asNumber(t iterator, o interface{}) float64 {
 		if node == nil {
 			return math.NaN()
 		}
-		return stringToNumber(node.Value())
+		return toNumber(t, node.Value())
 	case float64:
 		return typ
 	case string:
-		return stringToNumber(typ)
+		return toNumber(t, typ)
+	case Sequence:
+		if len(typ) == 0 {
+			return math.NaN()
+		}
+		return asNumber(t, typ[0].atomize())
 	case bool:
 		if typ {
 			return 1
@@ -255,6 +281,8 @@ func asBool(t iterator, v interface{}) bool {
 		return v != ""
 	case query:
 		return v.Select(t) != nil
+	case Sequence:
+		return v.effectiveBool()
 	default:
 		panic(fmt.Errorf("unexpected type: %T", v))
 	}
@@ -269,6 +297,40 @@ func stringToNumber(s string) float64 {
 	return f
 }
 
+// toNumber converts the string s to a number, using the XPath 1.0 rules in
+// strict mode.
+func toNumber(t iterator, s string) float64 {
+	if isStrict(t) {
+		return xpath1Number(s)
+	}
+	return stringToNumber(s)
+}
+
+// xpath1Number converts the string s to a number per the XPath 1.0 spec
+// (REC 4.4): an optional minus sign and digits with an optional decimal
+// point, surrounded by whitespace. Anything else, such as "1e3", "+1" or
+// "Infinity", is NaN.
+func xpath1Number(s string) float64 {
+	s = strings.Trim(s, " \t\r\n")
+	var digits int
+	point := false
+	for _, c := range strings.TrimPrefix(s, "-") {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && !point:
+			point = true
+		default:
+			return math.NaN()
+		}
+	}
+	if digits == 0 {
+		return math.NaN()
+	}
+	f, _ := strconv.ParseFloat(s, 64) // a number too large is ±Infinity
+	return f
+}
+
 // formatNumber converts a number to a string per the XPath 1.0 spec (REC 4.2):
 // no exponent for finite values, "Infinity"/"-Infinity", "NaN", and "0" for -0.
 func formatNumber(f float64) string {
@@ -305,6 +367,11 @@ func asString(t iterator, v interface{}) string {
 			return ""
 		}
 		return node.Value()
+	case Sequence:
+		if len(v) == 0 {
+			return ""
+		}
+		return v[0].String()
 	default:
 		panic(fmt.Errorf("unexpected type: %T", v))
 	}
@@ -452,17 +519,7 @@ func matchesFunc(arg1, arg2 query) func(query, iterator) interface{} {
 // normalizespaceFunc is XPath functions normalize-space(string?)
 func normalizespaceFunc(arg1 query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
-		var m string
-		switch typ := functionArgs(arg1).Evaluate(t).(type) {
-		case string:
-			m = typ
-		case query:
-			node := typ.Select(t)
-			if node == nil {
-				return ""
-			}
-			m = node.Value()
-		}
+		m := asString(t, functionArgs(arg1).Evaluate(t))
 		var b = builderPool.Get().(stringBuilder)
 		b.Grow(len(m))
 
@@ -586,17 +643,8 @@ func substringIndFunc(arg1, arg2 query, after bool) func(query, iterator) interf
 // equal to the number of characters in a given string.
 func stringLengthFunc(arg1 query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
-		switch v := functionArgs(arg1).Evaluate(t).(type) {
-		case string:
-			return float64(len(v))
-		case query:
-			node := v.Select(t)
-			if node == nil {
-				break
-			}
-			return float64(len(node.Value()))
-		}
-		return float64(0)
+		v := asString(t, functionArgs(arg1).Evaluate(t))
+		return float64(len(v))
 	}
 }
 
@@ -635,10 +683,273 @@ func replaceFunc(arg1, arg2, arg3 query) func(query, iterator) interface{} {
 			dst = strings.ReplaceAll(dst, fmt.Sprintf("$%d", idx), fmt.Sprintf("${%d}", idx))
 		}
 
-		return e.ReplaceAllString(str, dst)
+		var b []byte
+		last := 0
+		for _, m := range e.FindAllStringSubmatchIndex(str, -1) {
+			b = append(b, str[last:m[0]]...)
+			b = e.ExpandString(b, dst, str, m)
+			checkLength(t, len(b))
+			last = m[1]
+		}
+		b = append(b, str[last:]...)
+		return checkString(t, string(b))
+	}
+}
+
+// generateIDFunc is a XPath functions generate-id([node-set]).
+func generateIDFunc(arg query) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		var v NodeNavigator
+		if arg == nil {
+			v = t.Current()
+		} else {
+			v = arg.Clone().Select(t)
+			if v == nil {
+				return ""
+			}
+		}
+		return "id" + nodeIdentity(t, v)
 	}
 }
 
+// idFunc is XPATH functions id(object) function operation. It returns the
+// elements with the given IDs in document order. A navigator that indexes
+// the IDs of its document can implement MoveToID(id string) bool, moving to
+// the element with the ID id; otherwise the document is scanned for
+// elements that have one of the ID attributes attrs.
+func idFunc(attrs []string) func(query, iterator) func() NodeNavigator {
+	return func(q query, t iterator) func() NodeNavigator {
+		ids := make(map[string]bool)
+		switch v := functionArgs(q).Evaluate(t).(type) {
+		case query:
+			for node := v.Select(t); node != nil; node = v.Select(t) {
+				for _, id := range strings.Fields(node.Value()) {
+					ids[id] = true
+				}
+			}
+		default:
+			for _, id := range strings.Fields(asString(t, v)) {
+				ids[id] = true
+			}
+		}
+
+		root := t.Current().Copy()
+		root.MoveToRoot()
+		var list []NodeNavigator
+		type idNavigator interface {
+			MoveToID(string) bool
+		}
+		if _, ok := root.(idNavigator); ok {
+			m := make(map[uint64]bool)
+			for id := range ids {
+				node := root.Copy()
+				if !node.(idNavigator).MoveToID(id) {
+					continue
+				}
+				if code := getHashCode(node.Copy()); !m[code] {
+					m[code] = true
+					buffer(t)
+					list = append(list, node)
+				}
+			}
+			list = sortNodes(list)
+		} else if len(ids) > 0 {
+			list = scanIDs(t, root, attrs, ids)
+		}
+
+		var i int
+		return func() NodeNavigator {
+			if i >= len(list) {
+				return nil
+			}
+			node := list[i]
+			i++
+			return node
+		}
+	}
+}
+
+// scanIDs returns the elements below root that have one of the IDs ids, in
+// document order. Only the first element with a given ID is returned.
+func scanIDs(t iterator, root NodeNavigator, attrs []string, ids map[string]bool) []NodeNavigator {
+	var list []NodeNavigator
+	node := root.Copy()
+	level := 0
+	for len(ids) > 0 {
+		visit(t)
+		if node.MoveToChild() {
+			level++
+		} else {
+			for !node.MoveToNext() {
+				if level <= 1 {
+					return list
+				}
+				node.MoveToParent()
+				level--
+			}
+		}
+		if node.NodeType() != ElementNode {
+			continue
+		}
+		attr := node.Copy()
+		for attr.MoveToNextAttribute() {
+			if !isAttribute(attr, attrs) {
+				continue
+			}
+			if id := strings.TrimSpace(attr.Value()); ids[id] {
+				delete(ids, id)
+				buffer(t)
+				list = append(list, node.Copy())
+				break
+			}
+		}
+	}
+	return list
+}
+
+// isAttribute reports whether the attribute n has one of the names, given
+// as prefix:local-name or local-name. A name without a prefix only matches
+// an attribute without a prefix.
+func isAttribute(n NodeNavigator, names []string) bool {
+	name := n.LocalName()
+	if n.Prefix() != "" {
+		name = n.Prefix() + ":" + name
+	}
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// xslNamespace is the namespace of the properties of system-property().
+const xslNamespace = "http://www.w3.org/1999/XSL/Transform"
+
+// functionAvailableFunc is XPATH functions function-available(string)
+// function operation.
+func functionAvailableFunc(arg1 query, available func(string) bool) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		return available(asString(t, functionArgs(arg1).Evaluate(t)))
+	}
+}
+
+// elementAvailableFunc is XPATH functions element-available(string)
+// function operation. There are no XSLT instructions, so it is false.
+func elementAvailableFunc(arg1 query) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		asString(t, functionArgs(arg1).Evaluate(t))
+		return false
+	}
+}
+
+// systemPropertyFunc is XPATH functions system-property(string) function
+// operation. The properties are in the XSLT namespace, bound to the prefix
+// xsl unless namespaces binds it to another namespace. xsl:version is 1.0,
+// the version of XSLT whose functions are supported.
+func systemPropertyFunc(arg1 query, namespaces map[string]string) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		prefix, name := splitQName(asString(t, functionArgs(arg1).Evaluate(t)))
+		if ns, ok := namespaces[prefix]; ok {
+			if ns != xslNamespace {
+				return ""
+			}
+		} else if prefix != "xsl" {
+			return ""
+		}
+		switch name {
+		case "version":
+			return float64(1)
+		case "vendor":
+			return "antchfx"
+		case "vendor-url":
+			return "https://github.com/antchfx/xpath"
+		case "product-name":
+			return "antchfx/xpath"
+		case "product-version":
+			return packageVersion()
+		}
+		return ""
+	}
+}
+
+// unknownVersion is the product version reported when the build does not
+// record the version of this package, as in its own tests.
+const unknownVersion = "(devel)"
+
+// packageVersion returns the version of this package in the build, or
+// unknownVersion.
+func packageVersion() string {
+	const path = "github.com/antchfx/xpath"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknownVersion
+	}
+	version := ""
+	if info.Main.Path == path {
+		version = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			version = dep.Version
+			if dep.Replace != nil {
+				version = dep.Replace.Version
+			}
+		}
+	}
+	if version == "" {
+		return unknownVersion
+	}
+	return version
+}
+
+// splitQName splits the QName s into its prefix and local name.
+func splitQName(s string) (prefix, name string) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// langFunc is XPATH functions lang(string) function operation.
+func langFunc(arg1 query) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		lang := asString(t, functionArgs(arg1).Evaluate(t))
+		node := t.Current().Copy()
+		for {
+			if v, ok := xmlLang(node); ok {
+				return matchLang(v, lang)
+			}
+			if !node.MoveToParent() {
+				return false
+			}
+		}
+	}
+}
+
+// xmlLang returns the value of the xml:lang attribute of the element n.
+func xmlLang(n NodeNavigator) (string, bool) {
+	if n.NodeType() != ElementNode {
+		return "", false
+	}
+	attr := n.Copy()
+	for attr.MoveToNextAttribute() {
+		if (attr.Prefix() == "xml" && attr.LocalName() == "lang") || attr.LocalName() == "xml:lang" {
+			return attr.Value(), true
+		}
+	}
+	return "", false
+}
+
+// matchLang reports whether the language v is lang or a sub-language of
+// lang, ignoring case.
+func matchLang(v, lang string) bool {
+	if len(v) < len(lang) || !strings.EqualFold(v[:len(lang)], lang) {
+		return false
+	}
+	return len(v) == len(lang) || v[len(lang)] == '-'
+}
+
 // notFunc is XPATH functions not(expression) function operation.
 func notFunc(arg1 query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
@@ -648,6 +959,8 @@ func notFunc(arg1 query) func(query, iterator) interface{} {
 		case query:
 			node := v.Select(t)
 			return node == nil
+		case Sequence:
+			return !v.effectiveBool()
 		default:
 			return false
 		}
@@ -660,15 +973,19 @@ func notFunc(arg1 query) func(query, iterator) interface{} {
 func concatFunc(args ...query) func(query, iterator) interface{} {
 	return func(_ query, t iterator) interface{} {
 		b := builderPool.Get().(stringBuilder)
+		defer func() {
+			b.Reset()
+			builderPool.Put(b)
+		}()
+		n := 0
 		for _, v := range args {
 			v = functionArgs(v)
-			b.WriteString(asString(t, v.Evaluate(t)))
+			s := asString(t, v.Evaluate(t))
+			n += len(s)
+			checkLength(t, n)
+			b.WriteString(s)
 		}
-		result := b.String()
-		b.Reset()
-		builderPool.Put(b)
-
-		return result
+		return b.String()
 	}
 }
 
@@ -687,6 +1004,7 @@ func reverseFunc(q query, t iterator) func() NodeNavigator {
 		if node == nil {
 			break
 		}
+		buffer(t)
 		list = append(list, node.Copy())
 	}
 	i := len(list)
@@ -716,18 +1034,39 @@ func stringJoinFunc(q, arg1 query) func(query, iterator) interface{} {
 
 		q = functionArgs(q)
 		test := predicate(q)
-		var parts []string
+		b := builderPool.Get().(stringBuilder)
+		defer func() {
+			b.Reset()
+			builderPool.Put(b)
+		}()
+		n, count := 0, 0
+		join := func(s string) {
+			if count > 0 {
+				n += len(separator)
+			}
+			n += len(s)
+			checkLength(t, n)
+			if count > 0 {
+				b.WriteString(separator)
+			}
+			b.WriteString(s)
+			count++
+		}
 		switch v := q.Evaluate(t).(type) {
 		case string:
 			return v
 		case query:
 			for node := v.Select(t); node != nil; node = v.Select(t) {
 				if test(node) {
-					parts = append(parts, node.Value())
+					join(node.Value())
 				}
 			}
+		case Sequence:
+			for _, item := range v {
+				join(item.String())
+			}
 		}
-		return strings.Join(parts, separator)
+		return b.String()
 	}
 }
 
@@ -738,3 +1077,11 @@ func lowerCaseFunc(arg1 query) func(query, iterator) interface{} {
 		return strings.ToLower(asString(t, v))
 	}
 }
+
+// upper-case is XPATH function that converts a string to upper case.
+func upperCaseFunc(arg1 query) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		v := functionArgs(arg1).Evaluate(t)
+		return strings.ToUpper(asString(t, v))
+	}
+}
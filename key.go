@@ -0,0 +1,247 @@
+package xpath
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Key declares an index used by the key() function, like xsl:key. The
+// nodes matching the pattern Match are indexed by the string values of Use,
+// evaluated with each node as the context node.
+type Key struct {
+	// Match is a pattern, such as "customer" or "order/item | @id".
+	Match string
+
+	// Use is the expression that computes the key values of a node. A
+	// node-set gives a key value for each node.
+	Use string
+}
+
+// keyIndex is a compiled key. Its indexes are built during an evaluation
+// and kept by the KeyCache of the evaluation, so an expression holds no
+// document.
+type keyIndex struct {
+	id         keyID
+	match, use query
+}
+
+// keyID identifies a key in a KeyCache: the expressions that declare a key
+// with the same name and definition share its indexes.
+type keyID struct {
+	name string
+	key  Key
+}
+
+// keyTable is the index of a key for a document.
+type keyTable struct {
+	root  NodeNavigator // the root of the indexed document
+	nodes map[string][]NodeNavigator
+}
+
+// KeyCache keeps the indexes built by key() across evaluations, so that
+// the index of a key is built once for each document. It is set by
+// Options.KeyCache; without one, the indexes are kept for one evaluation
+// only. The cache holds the indexed documents until it is cleared or
+// dropped, and assumes that they are not modified. The zero value is an
+// empty cache, and a KeyCache is safe for concurrent use.
+type KeyCache struct {
+	mu     sync.Mutex
+	tables map[keyID][]keyTable
+}
+
+// Clear removes all the indexes from the cache.
+func (c *KeyCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tables = nil
+}
+
+// find returns the index of the key id for the document root.
+func (c *KeyCache) find(id keyID, root NodeNavigator) (map[string][]NodeNavigator, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, table := range c.tables[id] {
+		if table.root.Copy().MoveTo(root) {
+			return table.nodes, true
+		}
+	}
+	return nil, false
+}
+
+// add adds the index nodes of the key id for the document root.
+func (c *KeyCache) add(id keyID, root NodeNavigator, nodes map[string][]NodeNavigator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tables == nil {
+		c.tables = make(map[keyID][]keyTable)
+	}
+	c.tables[id] = append(c.tables[id], keyTable{root: root, nodes: nodes})
+}
+
+// getKeyCache returns the KeyCache of the evaluation of t, or nil if t
+// keeps none.
+func getKeyCache(t iterator) *KeyCache {
+	type keyCache interface {
+		keyCache() *KeyCache
+	}
+	if c, ok := t.(keyCache); ok {
+		return c.keyCache()
+	}
+	return nil
+}
+
+// compileKey compiles the key k with the settings of b.
+func (b *builder) compileKey(name string, k Key) (*keyIndex, error) {
+	kb := *b
+	kb.firstInput = nil
+	match, err := anchorPattern(parse(k.Match, b.namespaces, b.strict))
+	if err != nil {
+		return nil, fmt.Errorf("xpath: key %s: %v", name, err)
+	}
+	props := builderProps.None
+	matchQuery, err := kb.processNode(match, flagsEnum.None, &props)
+	if err != nil {
+		return nil, err
+	}
+	props = builderProps.None
+	useQuery, err := kb.processNode(parse(k.Use, b.namespaces, b.strict), flagsEnum.None, &props)
+	if err != nil {
+		return nil, err
+	}
+	return &keyIndex{id: keyID{name, k}, match: matchQuery, use: useQuery}, nil
+}
+
+// anchorPattern turns the pattern n into an expression selecting all the
+// nodes of the document that match it, by making each relative location
+// path start with //.
+func anchorPattern(n node) (node, error) {
+	switch n := n.(type) {
+	case *operatorNode:
+		if n.Op != "|" {
+			break
+		}
+		left, err := anchorPattern(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := anchorPattern(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return newOperatorNode(n.Op, left, right), nil
+	case *rootNode:
+		return n, nil
+	case *axisNode:
+		if n.Input == nil {
+			a := *n
+			a.Input = newAxisNode("descendant-or-self", allNode, "", "", "", newRootNode("/"))
+			return &a, nil
+		}
+		input, err := anchorPattern(n.Input)
+		if err != nil {
+			return nil, err
+		}
+		a := *n
+		a.Input = input
+		return &a, nil
+	case *filterNode:
+		input, err := anchorPattern(n.Input)
+		if err != nil {
+			return nil, err
+		}
+		return newFilterNode(input, n.Condition), nil
+	}
+	return nil, fmt.Errorf("%v is not a pattern", n)
+}
+
+// lookup returns the nodes of the document of t.Current() that have the
+// key value v, building the index if it is not in the KeyCache of the
+// evaluation.
+func (k *keyIndex) lookup(t iterator, v string) []NodeNavigator {
+	root := t.Current().Copy()
+	root.MoveToRoot()
+	cache := getKeyCache(t)
+	if cache != nil {
+		if nodes, ok := cache.find(k.id, root); ok {
+			return nodes[v]
+		}
+	}
+	// The cache is not locked while the index is built, as the key can
+	// use key() itself.
+	nodes := k.build(t, root)
+	if cache != nil {
+		cache.add(k.id, root, nodes)
+	}
+	return nodes[v]
+}
+
+// build indexes the document root.
+func (k *keyIndex) build(t iterator, root NodeNavigator) map[string][]NodeNavigator {
+	save := t.Current().Copy()
+	defer t.Current().MoveTo(save)
+
+	var matched []NodeNavigator
+	t.Current().MoveTo(root)
+	match := k.match.Clone()
+	match.Evaluate(t)
+	for node := match.Select(t); node != nil; node = match.Select(t) {
+		buffer(t)
+		matched = append(matched, node.Copy())
+	}
+
+	index := make(map[string][]NodeNavigator)
+	for _, node := range matched {
+		t.Current().MoveTo(node)
+		values := make(map[string]bool)
+		switch v := k.use.Clone().Evaluate(t).(type) {
+		case query:
+			for n := v.Select(t); n != nil; n = v.Select(t) {
+				values[n.Value()] = true
+			}
+		default:
+			values[asString(t, v)] = true
+		}
+		for value := range values {
+			index[value] = append(index[value], node)
+		}
+	}
+	return index
+}
+
+// keyFunc is XPATH functions key(string, object) function operation.
+func keyFunc(name query, keys map[string]*keyIndex) func(query, iterator) func() NodeNavigator {
+	return func(q query, t iterator) func() NodeNavigator {
+		keyName := asString(t, functionArgs(name).Evaluate(t))
+		k, ok := keys[keyName]
+		if !ok {
+			panic(fmt.Errorf("xpath: key %s is not defined", keyName))
+		}
+		var values []string
+		switch v := functionArgs(q).Evaluate(t).(type) {
+		case query:
+			for node := v.Select(t); node != nil; node = v.Select(t) {
+				values = append(values, node.Value())
+			}
+		default:
+			values = append(values, asString(t, v))
+		}
+
+		var list []NodeNavigator
+		for _, v := range values {
+			list = append(list, k.lookup(t, v)...)
+		}
+		if len(values) > 1 {
+			list = sortNodes(list)
+		}
+
+		var i int
+		return func() NodeNavigator {
+			if i >= len(list) {
+				return nil
+			}
+			node := list[i].Copy()
+			i++
+			return node
+		}
+	}
+}
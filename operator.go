@@ -1,16 +1,20 @@
 package xpath
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"strings"
+)
 
 // The XPath number operator function list.
 
 type logical func(iterator, string, interface{}, interface{}) bool
 
 var logicalFuncs = [][]logical{
-	{cmpBooleanBoolean, nil, nil, nil},
-	{nil, cmpNumericNumeric, cmpNumericString, cmpNumericNodeSet},
-	{nil, cmpStringNumeric, cmpStringString, cmpStringNodeSet},
-	{nil, cmpNodeSetNumeric, cmpNodeSetString, cmpNodeSetNodeSet},
+	{cmpBooleanBoolean, cmpBooleanAny, cmpBooleanAny, cmpBooleanAny},
+	{cmpBooleanAny, cmpNumericNumeric, cmpNumericString, cmpNumericNodeSet},
+	{cmpBooleanAny, cmpStringNumeric, cmpStringString, cmpStringNodeSet},
+	{cmpBooleanAny, cmpNodeSetNumeric, cmpNodeSetString, cmpNodeSetNodeSet},
 }
 
 // number vs number
@@ -33,14 +37,14 @@ func cmpNumberNumberF(op string, a, b float64) bool {
 }
 
 // string vs string
-func cmpStringStringF(op string, a, b string) bool {
+func cmpStringStringF(t iterator, op string, a, b string) bool {
 	switch op {
 	case "=":
 		return a == b
 	case "!=":
 		return a != b
 	case ">", "<", ">=", "<=":
-		return cmpNumberNumberF(op, stringToNumber(a), stringToNumber(b))
+		return cmpNumberNumberF(op, toNumber(t, a), toNumber(t, b))
 	}
 	return false
 }
@@ -51,10 +55,23 @@ func cmpBooleanBooleanF(op string, a, b bool) bool {
 		return a || b
 	case "and":
 		return a && b
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">", "<", ">=", "<=":
+		return cmpNumberNumberF(op, boolToNumber(a), boolToNumber(b))
 	}
 	return false
 }
 
+func boolToNumber(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func cmpNumericNumeric(t iterator, op string, m, n interface{}) bool {
 	a := m.(float64)
 	b := n.(float64)
@@ -64,7 +81,7 @@ func cmpNumericNumeric(t iterator, op string, m, n interface{}) bool {
 func cmpNumericString(t iterator, op string, m, n interface{}) bool {
 	a := m.(float64)
 	b := n.(string)
-	return cmpNumberNumberF(op, a, stringToNumber(b))
+	return cmpNumberNumberF(op, a, toNumber(t, b))
 }
 
 func cmpNumericNodeSet(t iterator, op string, m, n interface{}) bool {
@@ -76,7 +93,7 @@ func cmpNumericNodeSet(t iterator, op string, m, n interface{}) bool {
 		if node == nil {
 			break
 		}
-		if cmpNumberNumberF(op, a, stringToNumber(node.Value())) {
+		if cmpNumberNumberF(op, a, toNumber(t, node.Value())) {
 			return true
 		}
 	}
@@ -91,7 +108,7 @@ func cmpNodeSetNumeric(t iterator, op string, m, n interface{}) bool {
 		if node == nil {
 			break
 		}
-		if cmpNumberNumberF(op, stringToNumber(node.Value()), b) {
+		if cmpNumberNumberF(op, toNumber(t, node.Value()), b) {
 			return true
 		}
 	}
@@ -106,7 +123,7 @@ func cmpNodeSetString(t iterator, op string, m, n interface{}) bool {
 		if node == nil {
 			break
 		}
-		if cmpStringStringF(op, node.Value(), b) {
+		if cmpStringStringF(t, op, node.Value(), b) {
 			return true
 		}
 	}
@@ -128,7 +145,7 @@ func cmpNodeSetNodeSet(t iterator, op string, m, n interface{}) bool {
 		}
 
 		for {
-			if cmpStringStringF(op, x.Value(), y.Value()) {
+			if cmpStringStringF(t, op, x.Value(), y.Value()) {
 				return true
 			}
 			if y = b.Select(t); y == nil {
@@ -143,13 +160,13 @@ func cmpNodeSetNodeSet(t iterator, op string, m, n interface{}) bool {
 func cmpStringNumeric(t iterator, op string, m, n interface{}) bool {
 	a := m.(string)
 	b := n.(float64)
-	return cmpNumberNumberF(op, stringToNumber(a), b)
+	return cmpNumberNumberF(op, toNumber(t, a), b)
 }
 
 func cmpStringString(t iterator, op string, m, n interface{}) bool {
 	a := m.(string)
 	b := n.(string)
-	return cmpStringStringF(op, a, b)
+	return cmpStringStringF(t, op, a, b)
 }
 
 func cmpStringNodeSet(t iterator, op string, m, n interface{}) bool {
@@ -160,7 +177,7 @@ func cmpStringNodeSet(t iterator, op string, m, n interface{}) bool {
 		if node == nil {
 			break
 		}
-		if cmpStringStringF(op, a, node.Value()) {
+		if cmpStringStringF(t, op, a, node.Value()) {
 			return true
 		}
 	}
@@ -173,46 +190,153 @@ func cmpBooleanBoolean(t iterator, op string, m, n interface{}) bool {
 	return cmpBooleanBooleanF(op, a, b)
 }
 
-// eqFunc is an `=` operator.
-func eqFunc(t iterator, m, n interface{}) interface{} {
+// cmpBooleanAny compares a boolean with an object of another type (XPath
+// 1.0 REC §3.4). A node-set is converted to a boolean first. Then = and !=
+// compare both objects as booleans, and the other operators as numbers.
+func cmpBooleanAny(t iterator, op string, m, n interface{}) bool {
+	if _, ok := m.(query); ok {
+		m = asBool(t, m)
+	}
+	if _, ok := n.(query); ok {
+		n = asBool(t, n)
+	}
+	switch op {
+	case "=", "!=":
+		return cmpBooleanBooleanF(op, asBool(t, m), asBool(t, n))
+	}
+	return cmpNumberNumberF(op, asNumber(t, m), asNumber(t, n))
+}
+
+// compare applies the general comparison op to m and n.
+func compare(t iterator, op string, m, n interface{}) bool {
 	t1 := getXPathType(m)
 	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, "=", m, n)
+	if t1 == xpathResultType.Sequence || t2 == xpathResultType.Sequence {
+		return cmpSequence(t, op, m, n)
+	}
+	return logicalFuncs[t1][t2](t, op, m, n)
+}
+
+// reverseOp returns the comparison operator that gives the same result as
+// op with its operands swapped.
+func reverseOp(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return op
+}
+
+// cmpSequence compares m and n when one of them is a sequence. As for
+// node-sets, the comparison is true if it is true for an item of m and an
+// item of n, where a node is compared by its string value.
+func cmpSequence(t iterator, op string, m, n interface{}) bool {
+	left, right := asSequence(t, m), asSequence(t, n)
+	for _, x := range left {
+		a := x.atomize()
+		for _, y := range right {
+			b := y.atomize()
+			if logicalFuncs[getXPathType(a)][getXPathType(b)](t, op, a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareValues applies the value comparison op to the items x and y. A node
+// is compared by its string value, converted to the type of the other
+// operand if that is a number or a boolean. Strings are compared by their
+// code points, and false is less than true. Other operands cannot be
+// compared.
+func compareValues(t iterator, op string, x, y Item) bool {
+	a, b := x.atomize(), y.atomize()
+	if x.IsNode() && !y.IsNode() {
+		a = castUntyped(t, a.(string), b)
+	} else if y.IsNode() && !x.IsNode() {
+		b = castUntyped(t, b.(string), a)
+	}
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmpNumberNumberF(op, a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return cmpNumberNumberF(op, float64(strings.Compare(a, b)), 0)
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmpNumberNumberF(op, boolToNumber(a), boolToNumber(b))
+		}
+	}
+	panic(fmt.Errorf("xpath: cannot compare %s with %s", typeName(a), typeName(b)))
+}
+
+// castUntyped converts the string value s of a node to the type of v.
+func castUntyped(t iterator, s string, v interface{}) interface{} {
+	switch v.(type) {
+	case float64:
+		return toNumber(t, s)
+	case bool:
+		switch strings.TrimSpace(s) {
+		case "true", "1":
+			return true
+		case "false", "0":
+			return false
+		}
+		panic(fmt.Errorf("xpath: cannot convert %q to a boolean", s))
+	}
+	return s
+}
+
+// typeName returns the name of the type of the atomic value v.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// eqFunc is an `=` operator.
+func eqFunc(t iterator, m, n interface{}) interface{} {
+	return compare(t, "=", m, n)
 }
 
 // gtFunc is an `>` operator.
 func gtFunc(t iterator, m, n interface{}) interface{} {
-	t1 := getXPathType(m)
-	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, ">", m, n)
+	return compare(t, ">", m, n)
 }
 
 // geFunc is an `>=` operator.
 func geFunc(t iterator, m, n interface{}) interface{} {
-	t1 := getXPathType(m)
-	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, ">=", m, n)
+	return compare(t, ">=", m, n)
 }
 
 // ltFunc is an `<` operator.
 func ltFunc(t iterator, m, n interface{}) interface{} {
-	t1 := getXPathType(m)
-	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, "<", m, n)
+	return compare(t, "<", m, n)
 }
 
 // leFunc is an `<=` operator.
 func leFunc(t iterator, m, n interface{}) interface{} {
-	t1 := getXPathType(m)
-	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, "<=", m, n)
+	return compare(t, "<=", m, n)
 }
 
 // neFunc is an `!=` operator.
 func neFunc(t iterator, m, n interface{}) interface{} {
-	t1 := getXPathType(m)
-	t2 := getXPathType(n)
-	return logicalFuncs[t1][t2](t, "!=", m, n)
+	return compare(t, "!=", m, n)
 }
 
 // orFunc is an `or` operator.
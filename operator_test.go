@@ -13,6 +13,7 @@ func createComparisonDoc() *TNode {
 		{name: "High", value: "10"},
 		{name: "Padded", value: " 14 "},
 		{name: "Invalid", value: "abc"},
+		{name: "Exponent", value: "1e3"},
 	}
 	for _, node := range nodes {
 		child := root.createChildNode(node.name, ElementNode)
@@ -68,6 +69,17 @@ func TestXPathComparisons(t *testing.T) {
 		{name: "string less than node set", expr: `'2' < //High`, want: true},
 		{name: "node set less or equal string", expr: `//Low <= '2'`, want: true},
 		{name: "string greater or equal node set", expr: `'10' >= //High`, want: true},
+
+		{name: "boolean equals boolean", expr: `true() = true()`, want: true},
+		{name: "boolean differs from boolean", expr: `true() != false()`, want: true},
+		{name: "boolean equals number", expr: `true() = 2`, want: true},
+		{name: "number equals boolean", expr: `0 = false()`, want: true},
+		{name: "boolean equals string", expr: `'' = false()`, want: true},
+		{name: "boolean equals node set", expr: `//Low = true()`, want: true},
+		{name: "boolean equals empty node set", expr: `//Missing = false()`, want: true},
+		{name: "boolean relational number", expr: `true() < 2`, want: true},
+		{name: "number relational boolean", expr: `2 > true()`, want: true},
+		{name: "node set relational boolean", expr: `//Low > false()`, want: true},
 	}
 
 	for _, tt := range tests {
@@ -79,3 +91,41 @@ func TestXPathComparisons(t *testing.T) {
 		})
 	}
 }
+
+func TestStrictComparisons(t *testing.T) {
+	doc := createComparisonDoc()
+	tests := []struct {
+		expr        string
+		lax, strict interface{}
+	}{
+		{expr: `//Exponent = 1000`, lax: true, strict: false},
+		{expr: `number('1e3') = 1000`, lax: true, strict: false},
+		{expr: `number('+5') = 5`, lax: true, strict: false},
+		{expr: `number('Infinity') > 0`, lax: true, strict: false},
+		{expr: `number(' -1.5 ')`, lax: -1.5, strict: -1.5},
+		{expr: `number('.5')`, lax: 0.5, strict: 0.5},
+		{expr: `'1e1' < '20'`, lax: true, strict: false},
+		{expr: `//Padded = 14`, lax: true, strict: true},
+		{expr: `sum(//Low | //High)`, lax: float64(12), strict: float64(12)},
+		{expr: `sum(//Low | //Invalid) = 2`, lax: true, strict: false},
+	}
+	for _, tt := range tests {
+		expr := MustCompile(tt.expr)
+		if got := expr.Evaluate(createNavigator(doc)); got != tt.lax {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.lax)
+		}
+		expr, err := CompileWithOptions(tt.expr, &Options{Strict: true})
+		assertNoErr(t, err)
+		if got := expr.Evaluate(createNavigator(doc)); got != tt.strict {
+			t.Errorf("%s in strict mode: got %v, want %v", tt.expr, got, tt.strict)
+		}
+	}
+
+	for _, s := range []string{`//Root/(Low, High)`, `sum('1')`} {
+		expr, err := CompileWithOptions(s, &Options{Strict: true})
+		if err == nil {
+			_, err = expr.EvaluateWithOptions(createNavigator(doc), nil)
+		}
+		assertErr(t, err)
+	}
+}
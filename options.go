@@ -0,0 +1,187 @@
+package xpath
+
+import (
+	"context"
+	"fmt"
+)
+
+// defaultMaxDepth is the default maximum nesting depth of an expression.
+const defaultMaxDepth = 1024
+
+// defaultMaxSequenceLength is the default maximum number of items of a
+// sequence built by an evaluation.
+const defaultMaxSequenceLength = 1 << 22
+
+// defaultIDAttributes are the default names of the ID attributes.
+var defaultIDAttributes = []string{"xml:id", "id"}
+
+// Options holds the namespaces, variables, functions and options used to
+// compile and evaluate an XPath expression. The zero value compiles like
+// Compile.
+type Options struct {
+	// Namespaces maps the namespace prefixes used in the expression to
+	// namespace URIs.
+	Namespaces map[string]string
+
+	// Variables declares the variables the expression may reference when
+	// compiling, and holds their values when evaluating. A value must be a
+	// string, a number, a bool, a *NodeIterator, a []NodeNavigator, a
+	// []string or a Sequence.
+	Variables map[string]interface{}
+
+	// Functions resolves the functions that are not built in, before the
+	// functions registered by RegisterFunction.
+	Functions FunctionResolver
+
+	// Strict rejects the functions and syntax that are not part of XPath
+	// 1.0, such as lower-case(), key() and a/(b, c), and converts values
+	// with the exact XPath 1.0 rules, so that "1e3" is NaN as a number.
+	Strict bool
+
+	// StrictCustomFunctions lets a strict expression call the custom
+	// functions, of Functions and RegisterFunction, which Strict rejects
+	// otherwise.
+	StrictCustomFunctions bool
+
+	// Limits bounds the resources used by the expression.
+	Limits Limits
+
+	// Context stops the evaluation with Context.Err() once it is done, such
+	// as when a request times out. The default is never done.
+	Context context.Context
+
+	// IDAttributes are the names of the attributes holding the ID of an
+	// element, used by id() when the navigator has no MoveToID method. The
+	// default is xml:id and id.
+	IDAttributes []string
+
+	// DecimalFormats are the decimal formats used by format-number(), by
+	// name. The format with the empty name replaces the default format.
+	DecimalFormats map[string]*DecimalFormat
+
+	// Keys are the keys used by key(), by name.
+	Keys map[string]Key
+
+	// KeyCache keeps the indexes of the keys across the evaluations that
+	// use it. If it is nil, the indexes are built for each evaluation.
+	KeyCache *KeyCache
+}
+
+// Limits bounds the resources used by an expression. A zero field means the
+// default limit, which is no limit except for MaxDepth and
+// MaxSequenceLength. The evaluation
+// limits are applied by Expr.EvaluateWithOptions and Expr.SelectWithOptions; going over one of them
+// stops the evaluation with a *LimitError.
+type Limits struct {
+	// MaxDepth is the maximum nesting depth of the expression. The default
+	// is 1024.
+	MaxDepth int
+
+	// MaxNodesVisited is the maximum number of nodes visited by the axes
+	// of the expression during an evaluation. A node is counted each time
+	// an axis step tests it, so a node reached by two steps counts twice.
+	MaxNodesVisited int
+
+	// MaxBufferedNodes is the maximum number of nodes copied into buffers,
+	// such as by a union, last(), reverse() or the arguments and result of
+	// a custom function, during an evaluation. Atomic values such as the
+	// integers of a range are not counted.
+	MaxBufferedNodes int
+
+	// MaxResultSize is the maximum number of nodes in the node-set result.
+	MaxResultSize int
+
+	// MaxStringLength is the maximum length in bytes of a string built by
+	// concat(), string-join() or replace(), checked as the string grows.
+	MaxStringLength int
+
+	// MaxSequenceLength is the maximum number of items of a sequence built
+	// by a range, sequence, for or simple map expression. The default,
+	// which also applies to the evaluations without Options, is 4194304.
+	MaxSequenceLength int
+}
+
+// LimitError is the error returned when an evaluation goes over one of its
+// Limits.
+type LimitError struct {
+	// Limit is the name of the Limits field, such as "MaxNodesVisited".
+	Limit string
+
+	// Max is the value of the limit.
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("xpath: evaluation exceeded %s (%d)", e.Limit, e.Max)
+}
+
+// budget counts the resources used by an evaluation against its Limits.
+type budget struct {
+	limits   Limits
+	visited  int
+	buffered int
+	results  int
+}
+
+func newBudget(limits Limits) *budget {
+	if limits.MaxNodesVisited <= 0 && limits.MaxBufferedNodes <= 0 &&
+		limits.MaxResultSize <= 0 && limits.MaxStringLength <= 0 &&
+		limits.MaxSequenceLength <= 0 {
+		return nil
+	}
+	return &budget{limits: limits}
+}
+
+func (b *budget) visit() {
+	b.visited++
+	if max := b.limits.MaxNodesVisited; max > 0 && b.visited > max {
+		panic(&LimitError{Limit: "MaxNodesVisited", Max: max})
+	}
+}
+
+func (b *budget) buffer() {
+	b.buffered++
+	if max := b.limits.MaxBufferedNodes; max > 0 && b.buffered > max {
+		panic(&LimitError{Limit: "MaxBufferedNodes", Max: max})
+	}
+}
+
+func (b *budget) result() {
+	b.results++
+	if max := b.limits.MaxResultSize; max > 0 && b.results > max {
+		panic(&LimitError{Limit: "MaxResultSize", Max: max})
+	}
+}
+
+func (b *budget) checkLength(n int) {
+	if max := b.limits.MaxStringLength; max > 0 && n > max {
+		panic(&LimitError{Limit: "MaxStringLength", Max: max})
+	}
+}
+
+// FunctionResolver resolves a custom function by its namespace URI and
+// local name. It returns nil if there is no such function.
+type FunctionResolver interface {
+	ResolveFunction(namespaceURI, name string) *Function
+}
+
+// FunctionResolverFunc is an adapter to use an ordinary function as a
+// FunctionResolver.
+type FunctionResolverFunc func(namespaceURI, name string) *Function
+
+// ResolveFunction calls f(namespaceURI, name).
+func (f FunctionResolverFunc) ResolveFunction(namespaceURI, name string) *Function {
+	return f(namespaceURI, name)
+}
+
+// xpath1Functions are the functions of the XPath 1.0 core function
+// library, the only built-in functions of a strict expression.
+var xpath1Functions = map[string]bool{
+	"boolean": true, "ceiling": true, "concat": true, "contains": true,
+	"count": true, "false": true, "floor": true, "id": true, "lang": true,
+	"last": true, "local-name": true, "name": true, "namespace-uri": true,
+	"normalize-space": true, "not": true, "number": true, "position": true,
+	"round": true, "starts-with": true, "string": true,
+	"string-length": true, "substring": true, "substring-after": true,
+	"substring-before": true, "sum": true, "translate": true, "true": true,
+}
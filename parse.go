@@ -35,6 +35,8 @@ const (
 	itemNe                         // '!='
 	itemLe                         // '<='
 	itemGe                         // '>='
+	itemPrecedes                   // '<<'
+	itemFollows                    // '>>'
 	itemAnd                        // '&&'
 	itemOr                         // '||'
 	itemDotDot                     // '..'
@@ -43,6 +45,8 @@ const (
 	itemString                     // Quoted string constant
 	itemNumber                     // Number constant
 	itemAxe                        // Axe (like child::)
+	itemAssign                     // ':='
+	itemArrow                      // '=>'
 	itemEOF                        // END
 )
 
@@ -67,12 +71,18 @@ const (
 	nodeVariable
 	nodeConstantOperand
 	nodeGroup
+	nodeSequence
+	nodeIf
+	nodeFor
+	nodeQuantified
+	nodeLet
 )
 
 type parser struct {
 	r          *scanner
 	d          int
 	namespaces map[string]string
+	strict     bool // rejects the syntax that is not part of XPath 1.0
 }
 
 // newOperatorNode returns new operator node OperatorNode.
@@ -80,6 +90,31 @@ func newOperatorNode(op string, left, right node) node {
 	return &operatorNode{nodeType: nodeOperator, Op: op, Left: left, Right: right}
 }
 
+// newSequenceNode returns a new sequence node with the items.
+func newSequenceNode(items []node) node {
+	return &sequenceNode{nodeType: nodeSequence, Items: items}
+}
+
+// newIfNode returns a new conditional expression node.
+func newIfNode(cond, then, els node) node {
+	return &ifNode{nodeType: nodeIf, Cond: cond, Then: then, Else: els}
+}
+
+// newForNode returns a new for expression node.
+func newForNode(name string, in, ret node) node {
+	return &forNode{nodeType: nodeFor, Name: name, In: in, Return: ret}
+}
+
+// newQuantifiedNode returns a new some or every expression node.
+func newQuantifiedNode(every bool, name string, in, cond node) node {
+	return &quantifiedNode{nodeType: nodeQuantified, Every: every, Name: name, In: in, Satisfies: cond}
+}
+
+// newLetNode returns a new let expression node.
+func newLetNode(name string, value, ret node) node {
+	return &letNode{nodeType: nodeLet, Name: name, Value: value, Return: ret}
+}
+
 // newOperand returns new constant operand node OperandNode.
 func newOperandNode(v interface{}) node {
 	return &operandNode{nodeType: nodeConstantOperand, Val: v}
@@ -131,6 +166,12 @@ func testOp(r *scanner, op string) bool {
 	return r.typ == itemName && r.prefix == "" && r.name == op
 }
 
+// testKeyword reports whether the current item is the keyword name followed
+// by the character next, such as "for" followed by '$'.
+func testKeyword(r *scanner, name string, next rune) bool {
+	return testOp(r, name) && r.curr == next
+}
+
 func isPrimaryExpr(r *scanner) bool {
 	switch r.typ {
 	case itemString, itemNumber, itemDollar, itemLParens:
@@ -168,11 +209,78 @@ func (p *parser) parseExpression(n node) node {
 	if p.d = p.d + 1; p.d > 200 {
 		panic("the xpath query is too complex(depth > 200)")
 	}
-	n = p.parseOrExpr(n)
+	switch {
+	case testKeyword(p.r, "if", '('):
+		n = p.parseIfExpr(n)
+	case testKeyword(p.r, "for", '$'):
+		p.checkXPath2("a for expression")
+		p.next()
+		n = p.parseBindings(n, itemName, "return", newForNode)
+	case testKeyword(p.r, "some", '$'), testKeyword(p.r, "every", '$'):
+		every := p.r.name == "every"
+		p.checkXPath2("a quantified expression")
+		p.next()
+		n = p.parseBindings(n, itemName, "satisfies", func(name string, in, cond node) node {
+			return newQuantifiedNode(every, name, in, cond)
+		})
+	case testKeyword(p.r, "let", '$'):
+		p.checkXPath2("a let expression")
+		p.next()
+		n = p.parseBindings(n, itemAssign, "return", newLetNode)
+	default:
+		n = p.parseOrExpr(n)
+	}
 	p.d--
 	return n
 }
 
+// ForExpr ::= 'for' '$' VarName 'in' ExprSingle (',' '$' VarName 'in' ExprSingle)* 'return' ExprSingle
+// QuantifiedExpr ::= ('some' | 'every') '$' VarName 'in' ExprSingle (',' '$' VarName 'in' ExprSingle)* 'satisfies' ExprSingle
+// LetExpr ::= 'let' '$' VarName ':=' ExprSingle (',' '$' VarName ':=' ExprSingle)* 'return' ExprSingle
+//
+// parseBindings parses the variable bindings and the body of a for,
+// quantified or let expression, after its first keyword. A variable is
+// bound with the keyword in, or with ':=' if bind is itemAssign. The body
+// follows the keyword end. An expression with several variables is parsed
+// as nested expressions of one variable, made by newNode.
+func (p *parser) parseBindings(n node, bind itemType, end string, newNode func(name string, value, body node) node) node {
+	p.skipItem(itemDollar)
+	checkItem(p.r, itemName)
+	name := p.r.name
+	if p.r.prefix != "" {
+		name = p.r.prefix + ":" + name
+	}
+	p.next()
+	if bind == itemAssign {
+		p.skipItem(itemAssign)
+	} else {
+		p.skipKeyword("in")
+	}
+	value := p.parseExpression(n)
+	var body node
+	if p.r.typ == itemComma {
+		p.next()
+		body = p.parseBindings(n, bind, end, newNode)
+	} else {
+		p.skipKeyword(end)
+		body = p.parseExpression(n)
+	}
+	return newNode(name, value, body)
+}
+
+// IfExpr ::= 'if' '(' Expr ')' 'then' ExprSingle 'else' ExprSingle
+func (p *parser) parseIfExpr(n node) node {
+	p.checkXPath2("an if expression")
+	p.next()
+	p.skipItem(itemLParens)
+	cond := p.parseSequenceExpr(n)
+	p.skipItem(itemRParens)
+	p.skipKeyword("then")
+	then := p.parseExpression(n)
+	p.skipKeyword("else")
+	return newIfNode(cond, then, p.parseExpression(n))
+}
+
 // next scanning next item on forward.
 func (p *parser) next() bool {
 	return p.r.nextItem()
@@ -183,6 +291,29 @@ func (p *parser) skipItem(typ itemType) {
 	p.next()
 }
 
+// skipKeyword skips the keyword name, such as "then".
+func (p *parser) skipKeyword(name string) {
+	if !testOp(p.r, name) {
+		panic(fmt.Sprintf("%s: expected %s", p.r.text, name))
+	}
+	p.next()
+}
+
+// Expr ::= ExprSingle | Expr ',' ExprSingle
+func (p *parser) parseSequenceExpr(n node) node {
+	opnd := p.parseExpression(n)
+	if p.r.typ != itemComma {
+		return opnd
+	}
+	p.checkXPath2("a sequence")
+	items := []node{opnd}
+	for p.r.typ == itemComma {
+		p.next()
+		items = append(items, p.parseExpression(n))
+	}
+	return newSequenceNode(items)
+}
+
 // OrExpr ::= AndExpr | OrExpr 'or' AndExpr
 func (p *parser) parseOrExpr(n node) node {
 	opnd := p.parseAndExpr(n)
@@ -210,6 +341,9 @@ func (p *parser) parseAndExpr(n node) node {
 }
 
 // EqualityExpr ::= RelationalExpr | EqualityExpr '=' RelationalExpr | EqualityExpr '!=' RelationalExpr
+//
+//	| EqualityExpr 'eq' RelationalExpr | EqualityExpr 'ne' RelationalExpr
+//	| EqualityExpr 'is' RelationalExpr
 func (p *parser) parseEqualityExpr(n node) node {
 	opnd := p.parseRelationalExpr(n)
 Loop:
@@ -221,7 +355,16 @@ Loop:
 		case itemNe:
 			op = "!="
 		default:
-			break Loop
+			if testOp(p.r, "is") {
+				p.checkXPath2("a node comparison")
+				op = "is"
+				break
+			}
+			if !testOp(p.r, "eq") && !testOp(p.r, "ne") {
+				break Loop
+			}
+			p.checkXPath2("a value comparison")
+			op = p.r.name
 		}
 		p.next()
 		opnd = newOperatorNode(op, opnd, p.parseRelationalExpr(n))
@@ -233,8 +376,10 @@ Loop:
 //
 //	| RelationalExpr '<=' AdditiveExpr
 //	| RelationalExpr '>=' AdditiveExpr
+//	| RelationalExpr ('lt' | 'le' | 'gt' | 'ge') AdditiveExpr
+//	| RelationalExpr '<<' AdditiveExpr | RelationalExpr '>>' AdditiveExpr
 func (p *parser) parseRelationalExpr(n node) node {
-	opnd := p.parseAdditiveExpr(n)
+	opnd := p.parseRangeExpr(n)
 Loop:
 	for {
 		var op string
@@ -247,11 +392,32 @@ Loop:
 			op = "<="
 		case itemGe:
 			op = ">="
+		case itemPrecedes, itemFollows:
+			p.checkXPath2("a node comparison")
+			op = "<<"
+			if p.r.typ == itemFollows {
+				op = ">>"
+			}
 		default:
-			break Loop
+			if !testOp(p.r, "lt") && !testOp(p.r, "le") && !testOp(p.r, "gt") && !testOp(p.r, "ge") {
+				break Loop
+			}
+			p.checkXPath2("a value comparison")
+			op = p.r.name
 		}
 		p.next()
-		opnd = newOperatorNode(op, opnd, p.parseAdditiveExpr(n))
+		opnd = newOperatorNode(op, opnd, p.parseRangeExpr(n))
+	}
+	return opnd
+}
+
+// RangeExpr ::= AdditiveExpr | AdditiveExpr 'to' AdditiveExpr
+func (p *parser) parseRangeExpr(n node) node {
+	opnd := p.parseAdditiveExpr(n)
+	if testOp(p.r, "to") {
+		p.checkXPath2("a range expression")
+		p.next()
+		opnd = newOperatorNode("to", opnd, p.parseAdditiveExpr(n))
 	}
 	return opnd
 }
@@ -298,6 +464,10 @@ Loop:
 }
 
 // UnaryExpr ::= UnionExpr | '-' UnaryExpr
+//
+// The minus sign binds tighter than =>, so the signs are passed down to the
+// first arrow expression of the union, which takes them as part of its left
+// operand if it has one: -2 => f() is f(-2).
 func (p *parser) parseUnaryExpr(n node) node {
 	minus := false
 	// ignore '-' sequence
@@ -305,29 +475,75 @@ func (p *parser) parseUnaryExpr(n node) node {
 		p.next()
 		minus = !minus
 	}
-	opnd := p.parseUnionExpr(n)
+	opnd := p.parseUnionExpr(n, &minus)
 	if minus {
 		opnd = newOperatorNode("*", opnd, newOperandNode(float64(-1)))
 	}
 	return opnd
 }
 
-// UnionExpr ::= PathExpr | UnionExpr '|' PathExpr
-func (p *parser) parseUnionExpr(n node) node {
-	opnd := p.parsePathExpr(n)
+// UnionExpr ::= IntersectExceptExpr | UnionExpr '|' IntersectExceptExpr
+func (p *parser) parseUnionExpr(n node, minus *bool) node {
+	opnd := p.parseIntersectExceptExpr(n, minus)
 Loop:
 	for {
 		if p.r.typ != itemUnion {
 			break Loop
 		}
 		p.next()
-		opnd2 := p.parsePathExpr(n)
+		opnd2 := p.parseIntersectExceptExpr(n, nil)
 		// Checking the node type that must be is node set type?
 		opnd = newOperatorNode("|", opnd, opnd2)
 	}
 	return opnd
 }
 
+// IntersectExceptExpr ::= ArrowExpr | IntersectExceptExpr ('intersect' | 'except') ArrowExpr
+func (p *parser) parseIntersectExceptExpr(n node, minus *bool) node {
+	opnd := p.parseArrowExpr(n, minus)
+	for testOp(p.r, "intersect") || testOp(p.r, "except") {
+		op := p.r.name
+		p.checkXPath2("the " + op + " operator")
+		p.next()
+		opnd = newOperatorNode(op, opnd, p.parseArrowExpr(n, nil))
+	}
+	return opnd
+}
+
+// ArrowExpr ::= ArrowOperand | ArrowExpr '=>' FunctionCall
+// ArrowOperand ::= SimpleMapExpr | '-' ArrowOperand
+//
+// The value of the left operand is the first argument of the function call.
+// The signs of the left operand are those parsed by the UnaryExpr; if minus
+// is set and the expression has an arrow, it takes the sign and clears minus.
+func (p *parser) parseArrowExpr(n node, minus *bool) node {
+	opnd := p.parseSimpleMapExpr(n)
+	if p.r.typ == itemArrow && minus != nil && *minus {
+		opnd = newOperatorNode("*", opnd, newOperandNode(float64(-1)))
+		*minus = false
+	}
+	for p.r.typ == itemArrow {
+		p.checkXPath2("the => operator")
+		p.next()
+		checkItem(p.r, itemName)
+		fn := p.parseMethod(n).(*functionNode)
+		fn.Args = append([]node{opnd}, fn.Args...)
+		opnd = fn
+	}
+	return opnd
+}
+
+// SimpleMapExpr ::= PathExpr | SimpleMapExpr '!' PathExpr
+func (p *parser) parseSimpleMapExpr(n node) node {
+	opnd := p.parsePathExpr(n)
+	for p.r.typ == itemBang {
+		p.checkXPath2("the ! operator")
+		p.next()
+		opnd = newOperatorNode("!", opnd, p.parsePathExpr(n))
+	}
+	return opnd
+}
+
 // PathExpr ::= LocationPath | FilterExpr | FilterExpr '/' RelativeLocationPath	| FilterExpr '//' RelativeLocationPath
 func (p *parser) parsePathExpr(n node) node {
 	var opnd node
@@ -424,11 +640,15 @@ func (p *parser) parseStep(n node) (opnd node) {
 			axisType = p.r.name
 			p.next()
 		case itemLParens:
+			p.checkXPath2("a parenthesized step")
 			return p.parseSequence(n)
 		}
 		matchType := ElementNode
-		if axisType == "attribute" {
+		switch axisType {
+		case "attribute":
 			matchType = AttributeNode
+		case "namespace":
+			matchType = NamespaceNode
 		}
 		opnd = p.parseNodeTest(n, axisType, matchType)
 	}
@@ -479,6 +699,7 @@ func (p *parser) parseNodeTest(n node, axeTyp string, matchType NodeType) (opnd
 			case "text":
 				matchType = TextNode
 			case "processing-instruction":
+				matchType = ProcessingInstructionNode
 			case "node":
 				matchType = allNode
 			default:
@@ -529,8 +750,13 @@ func (p *parser) parsePrimaryExpr(n node) (opnd node) {
 		p.next()
 	case itemLParens:
 		p.next()
-		opnd = p.parseExpression(n)
-		if opnd.Type() != nodeConstantOperand {
+		if p.r.typ == itemRParens {
+			p.checkXPath2("an empty sequence")
+			p.next()
+			return newSequenceNode(nil)
+		}
+		opnd = p.parseSequenceExpr(n)
+		if t := opnd.Type(); t != nodeConstantOperand && t != nodeSequence {
 			opnd = newGroupNode(opnd)
 		}
 		p.skipItem(itemRParens)
@@ -564,12 +790,20 @@ func (p *parser) parseMethod(n node) node {
 }
 
 // Parse parsing the XPath express string expr and returns a tree node.
-func parse(expr string, namespaces map[string]string) node {
+func parse(expr string, namespaces map[string]string, strict bool) node {
 	r := &scanner{text: expr}
 	r.nextChar()
 	r.nextItem()
-	p := &parser{r: r, namespaces: namespaces}
-	return p.parseExpression(nil)
+	p := &parser{r: r, namespaces: namespaces, strict: strict}
+	return p.parseSequenceExpr(nil)
+}
+
+// checkXPath2 rejects the construct what in strict mode, where only the
+// XPath 1.0 syntax is allowed.
+func (p *parser) checkXPath2(what string) {
+	if p.strict {
+		panic(fmt.Sprintf("%s: %s is not XPath 1.0", p.r.text, what))
+	}
 }
 
 // rootNode holds a top-level node of tree.
@@ -641,6 +875,73 @@ func (g *groupNode) String() string {
 	return fmt.Sprintf("%s", g.Input)
 }
 
+// sequenceNode holds the items of a sequence expression.
+type sequenceNode struct {
+	nodeType
+	Items []node
+}
+
+func (s *sequenceNode) String() string {
+	var b bytes.Buffer
+	b.WriteString("(")
+	for i, item := range s.Items {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s", item)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// ifNode holds a conditional expression.
+type ifNode struct {
+	nodeType
+	Cond, Then, Else node
+}
+
+func (i *ifNode) String() string {
+	return fmt.Sprintf("if (%s) then %s else %s", i.Cond, i.Then, i.Else)
+}
+
+// forNode holds a for expression with one variable.
+type forNode struct {
+	nodeType
+	Name       string // the variable name, with its prefix
+	In, Return node
+}
+
+func (f *forNode) String() string {
+	return fmt.Sprintf("for $%s in %s return %s", f.Name, f.In, f.Return)
+}
+
+// quantifiedNode holds a some or every expression with one variable.
+type quantifiedNode struct {
+	nodeType
+	Every         bool
+	Name          string // the variable name, with its prefix
+	In, Satisfies node
+}
+
+func (q *quantifiedNode) String() string {
+	quantifier := "some"
+	if q.Every {
+		quantifier = "every"
+	}
+	return fmt.Sprintf("%s $%s in %s satisfies %s", quantifier, q.Name, q.In, q.Satisfies)
+}
+
+// letNode holds a let expression with one variable.
+type letNode struct {
+	nodeType
+	Name          string // the variable name, with its prefix
+	Value, Return node
+}
+
+func (l *letNode) String() string {
+	return fmt.Sprintf("let $%s := %s return %s", l.Name, l.Value, l.Return)
+}
+
 // filterNode holds a condition filter.
 type filterNode struct {
 	nodeType
@@ -723,15 +1024,25 @@ func (s *scanner) nextItem() bool {
 	case 0:
 		s.typ = itemEOF
 		return false
-	case ',', '@', '(', ')', '|', '*', '[', ']', '+', '-', '=', '#', '$':
+	case ',', '@', '(', ')', '|', '*', '[', ']', '+', '-', '#', '$':
 		s.typ = asItemType(s.curr)
 		s.nextChar()
+	case '=':
+		s.typ = itemEq
+		s.nextChar()
+		if s.curr == '>' {
+			s.typ = itemArrow
+			s.nextChar()
+		}
 	case '<':
 		s.typ = itemLt
 		s.nextChar()
 		if s.curr == '=' {
 			s.typ = itemLe
 			s.nextChar()
+		} else if s.curr == '<' {
+			s.typ = itemPrecedes
+			s.nextChar()
 		}
 	case '>':
 		s.typ = itemGt
@@ -739,6 +1050,9 @@ func (s *scanner) nextItem() bool {
 		if s.curr == '=' {
 			s.typ = itemGe
 			s.nextChar()
+		} else if s.curr == '>' {
+			s.typ = itemFollows
+			s.nextChar()
 		}
 	case '!':
 		s.typ = itemBang
@@ -767,6 +1081,13 @@ func (s *scanner) nextItem() bool {
 	case '"', '\'':
 		s.typ = itemString
 		s.strval = s.scanString()
+	case ':':
+		if !s.atAssign() {
+			panic(fmt.Sprintf("%s has an invalid token.", s.text))
+		}
+		s.typ = itemAssign
+		s.nextChar()
+		s.nextChar()
 	default:
 		if isDigit(s.curr) {
 			s.typ = itemNumber
@@ -777,7 +1098,7 @@ func (s *scanner) nextItem() bool {
 			s.prefix = ""
 			// "foo:bar" is one itemem not three because it doesn't allow spaces in between
 			// We should distinct it from "foo::" and need process "foo ::" as well
-			if s.curr == ':' {
+			if s.curr == ':' && !s.atAssign() {
 				s.nextChar()
 				// can be "foo:bar" or "foo::"
 				if s.curr == ':' {
@@ -797,7 +1118,7 @@ func (s *scanner) nextItem() bool {
 				}
 			} else {
 				s.skipSpace()
-				if s.curr == ':' {
+				if s.curr == ':' && !s.atAssign() {
 					s.nextChar()
 					// it can be "foo ::" or just "foo :"
 					if s.curr == ':' {
@@ -817,6 +1138,11 @@ func (s *scanner) nextItem() bool {
 	return true
 }
 
+// atAssign reports whether the scanner is at the ':=' of a let binding.
+func (s *scanner) atAssign() bool {
+	return s.curr == ':' && s.pos < len(s.text) && s.text[s.pos] == '='
+}
+
 func (s *scanner) skipSpace() {
 Loop:
 	for {
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 )
 
@@ -20,12 +22,15 @@ var xpathResultType = struct {
 	NodeSet resultType
 	// Any of the XPath node types.
 	Any resultType
+	// A sequence of nodes and atomic values.
+	Sequence resultType
 }{
-	Boolean: 0,
-	Number:  1,
-	String:  2,
-	NodeSet: 3,
-	Any:     4,
+	Boolean:  0,
+	Number:   1,
+	String:   2,
+	NodeSet:  3,
+	Any:      4,
+	Sequence: 5,
 }
 
 type queryProp int
@@ -84,12 +89,21 @@ func (nopQuery) Properties() queryProp {
 // contextQuery is returns current node on the iterator object query.
 type contextQuery struct {
 	count int
+
+	// Atomic is set in the right operand of a ! expression, where the
+	// context item may be an atomic value rather than a node.
+	Atomic bool
 }
 
 func (c *contextQuery) Select(t iterator) NodeNavigator {
 	if c.count > 0 {
 		return nil
 	}
+	if c.Atomic {
+		if v, ok := contextItem(t); ok {
+			panic(fmt.Errorf("xpath: the context item is not a node: %v", v))
+		}
+	}
 	c.count++
 	return t.Current().Copy()
 }
@@ -100,7 +114,7 @@ func (c *contextQuery) Evaluate(iterator) interface{} {
 }
 
 func (c *contextQuery) Clone() query {
-	return &contextQuery{}
+	return &contextQuery{Atomic: c.Atomic}
 }
 
 func (c *contextQuery) ValueType() resultType {
@@ -172,11 +186,15 @@ func (a *ancestorQuery) Select(t iterator) NodeNavigator {
 			a.iterator = func() NodeNavigator {
 				if first {
 					first = false
-					if a.Self && a.Predicate(node) {
-						return node
+					if a.Self {
+						visit(t)
+						if a.Predicate(node) {
+							return node
+						}
 					}
 				}
 				for node.MoveToParent() {
+					visit(t)
 					if a.Predicate(node) {
 						return node
 					}
@@ -252,6 +270,7 @@ func (a *attributeQuery) Select(t iterator) NodeNavigator {
 					if !onAttr {
 						return nil
 					}
+					visit(t)
 					if a.Predicate(node) {
 						return node
 					}
@@ -288,6 +307,77 @@ func (a *attributeQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// namespaceQuery is an XPath namespace node query.(namespace::*)
+// The namespace nodes are read from a navigator that implements
+// MoveToNextNamespace() bool, which moves an element to its next in-scope
+// namespace like MoveToNextAttribute moves it to its next attribute.
+// MoveToParent moves a namespace node back to its element.
+type namespaceQuery struct {
+	name     string
+	iterator func() NodeNavigator
+
+	Input     query
+	Predicate func(NodeNavigator) bool
+}
+
+type namespaceNavigator interface {
+	MoveToNextNamespace() bool
+}
+
+func (q *namespaceQuery) Select(t iterator) NodeNavigator {
+	for {
+		if q.iterator == nil {
+			node := q.Input.Select(t)
+			if node == nil {
+				return nil
+			}
+			node = node.Copy()
+			nav, ok := node.(namespaceNavigator)
+			if !ok || node.NodeType() != ElementNode {
+				continue
+			}
+			q.iterator = func() NodeNavigator {
+				for {
+					if !nav.MoveToNextNamespace() {
+						return nil
+					}
+					visit(t)
+					if q.Predicate(node) {
+						return node
+					}
+				}
+			}
+		}
+
+		if node := q.iterator(); node != nil {
+			return node
+		}
+		q.iterator = nil
+	}
+}
+
+func (q *namespaceQuery) Evaluate(t iterator) interface{} {
+	q.Input.Evaluate(t)
+	q.iterator = nil
+	return q
+}
+
+func (q *namespaceQuery) Test(n NodeNavigator) bool {
+	return q.Predicate(n)
+}
+
+func (q *namespaceQuery) Clone() query {
+	return &namespaceQuery{name: q.name, Input: q.Input.Clone(), Predicate: q.Predicate}
+}
+
+func (q *namespaceQuery) ValueType() resultType {
+	return xpathResultType.NodeSet
+}
+
+func (q *namespaceQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
 // childQuery is an XPath child node query.(child::*)
 type childQuery struct {
 	name     string
@@ -314,6 +404,7 @@ func (c *childQuery) Select(t iterator) NodeNavigator {
 						return nil
 					}
 					first = false
+					visit(t)
 					if c.Predicate(node) {
 						return node
 					}
@@ -381,6 +472,7 @@ func (c *cachedChildQuery) Select(t iterator) NodeNavigator {
 						return nil
 					}
 					first = false
+					visit(t)
 					if c.Predicate(node) {
 						return node
 					}
@@ -448,8 +540,11 @@ func (d *descendantQuery) Select(t iterator) NodeNavigator {
 			d.iterator = func() NodeNavigator {
 				if first {
 					first = false
-					if d.Self && d.Predicate(node) {
-						return node
+					if d.Self {
+						visit(t)
+						if d.Predicate(node) {
+							return node
+						}
 					}
 				}
 
@@ -468,6 +563,7 @@ func (d *descendantQuery) Select(t iterator) NodeNavigator {
 							d.level = d.level - 1
 						}
 					}
+					visit(t)
 					if d.Predicate(node) {
 						return node
 					}
@@ -514,6 +610,100 @@ func (d *descendantQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// descendantChildQuery is a child step over a descendant step, such as
+// //a/b. It walks the descendants of each input node once and selects the
+// nodes whose parent is selected by the descendant step, so the children of
+// nested parents come in document order without being buffered.
+type descendantChildQuery struct {
+	name     string
+	iterator func() NodeNavigator
+	posit    int
+	level    int
+
+	Self      bool // The descendant step selects the input node too.
+	Input     query
+	Parent    func(NodeNavigator) bool
+	Predicate func(NodeNavigator) bool
+}
+
+func (d *descendantChildQuery) Select(t iterator) NodeNavigator {
+	for {
+		if d.iterator == nil {
+			d.posit = 0
+			node := d.Input.Select(t)
+			if node == nil {
+				return nil
+			}
+			node = node.Copy()
+			d.level = 0
+			// parents tells for each level of the walk whether the node is
+			// selected by the descendant step, and counts tells how many of
+			// its children have been selected.
+			parents := []bool{d.Self && d.Parent(node)}
+			counts := []int{0}
+			d.iterator = func() NodeNavigator {
+				for {
+					if node.MoveToChild() {
+						d.level = d.level + 1
+					} else {
+						for {
+							if d.level == 0 {
+								return nil
+							}
+							if node.MoveToNext() {
+								break
+							}
+							node.MoveToParent()
+							d.level = d.level - 1
+						}
+					}
+					visit(t)
+					parents = append(parents[:d.level], d.Parent(node))
+					counts = append(counts[:d.level], 0)
+					if parents[d.level-1] && d.Predicate(node) {
+						counts[d.level-1]++
+						d.posit = counts[d.level-1]
+						return node
+					}
+				}
+			}
+		}
+
+		if node := d.iterator(); node != nil {
+			return node
+		}
+		d.iterator = nil
+	}
+}
+
+func (d *descendantChildQuery) Evaluate(t iterator) interface{} {
+	d.Input.Evaluate(t)
+	d.iterator = nil
+	return d
+}
+
+func (d *descendantChildQuery) Test(n NodeNavigator) bool {
+	return d.Predicate(n)
+}
+
+// position returns the position of the current node among the selected
+// children of its parent.
+func (d *descendantChildQuery) position() int {
+	return d.posit
+}
+
+func (d *descendantChildQuery) Clone() query {
+	return &descendantChildQuery{name: d.name, Self: d.Self, Input: d.Input.Clone(), Parent: d.Parent, Predicate: d.Predicate}
+}
+
+func (d *descendantChildQuery) ValueType() resultType {
+	return xpathResultType.NodeSet
+}
+
+func (d *descendantChildQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
 // followingQuery is an XPath following node query.(following::*|following-sibling::*)
 type followingQuery struct {
 	posit    int
@@ -539,6 +729,7 @@ func (f *followingQuery) Select(t iterator) NodeNavigator {
 						if !node.MoveToNext() {
 							return nil
 						}
+						visit(t)
 						if f.Predicate(node) {
 							f.posit++
 							return node
@@ -625,9 +816,10 @@ func (p *precedingQuery) Select(t iterator) NodeNavigator {
 			if p.Sibling {
 				p.iterator = func() NodeNavigator {
 					for {
-						for !node.MoveToPrevious() {
+						if !node.MoveToPrevious() {
 							return nil
 						}
+						visit(t)
 						if p.Predicate(node) {
 							p.posit++
 							return node
@@ -697,6 +889,12 @@ func (p *precedingQuery) position() int {
 type parentQuery struct {
 	Input     query
 	Predicate func(NodeNavigator) bool
+
+	// Siblings is the node test of Input if it is a child or descendant
+	// step, which selects all the siblings of a node that pass the test.
+	// The parent of a node is then skipped if it has a previous sibling
+	// that passes the test, as the parent was selected for that sibling.
+	Siblings func(NodeNavigator) bool
 }
 
 func (p *parentQuery) Select(t iterator) NodeNavigator {
@@ -706,7 +904,14 @@ func (p *parentQuery) Select(t iterator) NodeNavigator {
 			return nil
 		}
 		node = node.Copy()
-		if node.MoveToParent() && p.Predicate(node) {
+		if p.Siblings != nil && hasPrevious(node.Copy(), p.Siblings) {
+			continue
+		}
+		if !node.MoveToParent() {
+			continue
+		}
+		visit(t)
+		if p.Predicate(node) {
 			return node
 		}
 	}
@@ -718,7 +923,18 @@ func (p *parentQuery) Evaluate(t iterator) interface{} {
 }
 
 func (p *parentQuery) Clone() query {
-	return &parentQuery{Input: p.Input.Clone(), Predicate: p.Predicate}
+	return &parentQuery{Input: p.Input.Clone(), Predicate: p.Predicate, Siblings: p.Siblings}
+}
+
+// hasPrevious reports whether a previous sibling of n passes the test,
+// moving n to it.
+func hasPrevious(n NodeNavigator, test func(NodeNavigator) bool) bool {
+	for n.MoveToPrevious() {
+		if test(n) {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *parentQuery) ValueType() resultType {
@@ -745,7 +961,7 @@ func (s *selfQuery) Select(t iterator) NodeNavigator {
 		if node == nil {
 			return nil
 		}
-
+		visit(t)
 		if s.Predicate(node) {
 			return node
 		}
@@ -773,6 +989,37 @@ func (s *selfQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// contextItemQuery is the context item expression . in the right operand
+// of a ! expression. It evaluates to the context item when it is an atomic
+// value, and selects the context node otherwise.
+type contextItemQuery struct {
+	Self query
+}
+
+func (c *contextItemQuery) Select(t iterator) NodeNavigator {
+	return c.Self.Select(t)
+}
+
+func (c *contextItemQuery) Evaluate(t iterator) interface{} {
+	if v, ok := contextItem(t); ok {
+		return v
+	}
+	c.Self.Evaluate(t)
+	return c
+}
+
+func (c *contextItemQuery) Clone() query {
+	return &contextItemQuery{Self: c.Self.Clone()}
+}
+
+func (c *contextItemQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (c *contextItemQuery) Properties() queryProp {
+	return c.Self.Properties()
+}
+
 // filterQuery is an XPath query for predicate filter.
 type filterQuery struct {
 	Input      query
@@ -784,7 +1031,15 @@ type filterQuery struct {
 }
 
 func (f *filterQuery) do(t iterator) bool {
-	val := reflect.ValueOf(f.Predicate.Evaluate(t))
+	v := f.Predicate.Evaluate(t)
+	if seq, ok := v.(Sequence); ok {
+		// A sequence of one number is a position.
+		if len(seq) != 1 || seq[0].Node != nil {
+			return seq.effectiveBool()
+		}
+		v = seq[0].Value
+	}
+	val := reflect.ValueOf(v)
 	switch val.Kind() {
 	case reflect.Bool:
 		return val.Bool()
@@ -917,6 +1172,82 @@ func (f *transformFunctionQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// customFunctionQuery is a call to a function registered by RegisterFunction.
+// A function that returns a node-set can be used as a location path input.
+type customFunctionQuery struct {
+	list  []NodeNavigator
+	posit int
+	bound bool
+
+	Name string
+	Func *Function
+	Args []query
+}
+
+func (c *customFunctionQuery) Select(t iterator) NodeNavigator {
+	if !c.bound {
+		c.Evaluate(t)
+	}
+	if c.posit >= len(c.list) {
+		return nil
+	}
+	node := c.list[c.posit]
+	c.posit++
+	return node
+}
+
+func (c *customFunctionQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	args := make([]interface{}, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = convertArg(t, c.Name, c.Func.argType(i), functionArgs(arg).Evaluate(t))
+		t.Current().MoveTo(root)
+	}
+	val, err := c.Func.Call(root.Copy(), args)
+	if err != nil {
+		panic(err)
+	}
+	val = convertResult(t, c.Name, c.Func.Returns, val)
+	c.bound = true
+	c.posit = 0
+	if list, ok := val.([]NodeNavigator); ok {
+		c.list = list
+		return c
+	}
+	c.list = nil
+	return val
+}
+
+func (c *customFunctionQuery) Clone() query {
+	args := make([]query, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.Clone()
+	}
+	return &customFunctionQuery{Name: c.Name, Func: c.Func, Args: args}
+}
+
+func (c *customFunctionQuery) ValueType() resultType {
+	switch c.Func.Returns {
+	case StringType:
+		return xpathResultType.String
+	case NumberType:
+		return xpathResultType.Number
+	case BooleanType:
+		return xpathResultType.Boolean
+	case NodeSetType:
+		return xpathResultType.NodeSet
+	}
+	return xpathResultType.Any
+}
+
+func (c *customFunctionQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+func (c *customFunctionQuery) position() int {
+	return c.posit
+}
+
 // constantQuery is an XPath constant operand.
 type constantQuery struct {
 	Val interface{}
@@ -977,6 +1308,60 @@ func (g *groupQuery) position() int {
 	return g.posit
 }
 
+// variableQuery is an XPath variable reference whose value is supplied
+// when the expression is evaluated.
+type variableQuery struct {
+	list  []NodeNavigator
+	posit int
+	bound bool
+
+	Name string
+}
+
+func (v *variableQuery) Select(t iterator) NodeNavigator {
+	if !v.bound {
+		v.Evaluate(t)
+	}
+	if v.posit >= len(v.list) {
+		return nil
+	}
+	// The bound nodes are shared by the evaluations, so they are not moved.
+	node := v.list[v.posit].Copy()
+	v.posit++
+	return node
+}
+
+func (v *variableQuery) Evaluate(t iterator) interface{} {
+	val, ok := getVariable(t, v.Name)
+	if !ok {
+		panic(&VariableError{Name: v.Name})
+	}
+	v.bound = true
+	v.posit = 0
+	if list, ok := val.([]NodeNavigator); ok {
+		v.list = list
+		return v
+	}
+	v.list = nil
+	return val
+}
+
+func (v *variableQuery) Clone() query {
+	return &variableQuery{Name: v.Name}
+}
+
+func (v *variableQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (v *variableQuery) Properties() queryProp {
+	return queryProps.Position | queryProps.Count | queryProps.Cached | queryProps.Merge
+}
+
+func (v *variableQuery) position() int {
+	return v.posit
+}
+
 // logicalQuery is an XPath logical expression.
 type logicalQuery struct {
 	Left, Right query
@@ -1142,6 +1527,51 @@ func (b *booleanQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// ifQuery is an XPath 2.0 conditional expression, whose value is the value
+// of Then if the effective boolean value of Cond is true, and of Else
+// otherwise.
+type ifQuery struct {
+	Cond, Then, Else query
+	nodes            query // the node-set of the chosen branch
+}
+
+func (q *ifQuery) Select(t iterator) NodeNavigator {
+	if q.nodes == nil {
+		if _, ok := q.Evaluate(t).(query); !ok {
+			panic(fmt.Errorf("xpath: the value of the if expression is not a node-set"))
+		}
+	}
+	return q.nodes.Select(t)
+}
+
+func (q *ifQuery) Evaluate(t iterator) interface{} {
+	q.nodes = nil
+	root := t.Current().Copy()
+	branch := q.Else
+	if asBool(t, q.Cond.Evaluate(t)) {
+		branch = q.Then
+	}
+	t.Current().MoveTo(root)
+	v := branch.Evaluate(t)
+	if nodes, ok := v.(query); ok {
+		q.nodes = nodes
+		return q
+	}
+	return v
+}
+
+func (q *ifQuery) Clone() query {
+	return &ifQuery{Cond: q.Cond.Clone(), Then: q.Then.Clone(), Else: q.Else.Clone()}
+}
+
+func (q *ifQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (q *ifQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
 type unionQuery struct {
 	Left, Right query
 	iterator    func() NodeNavigator
@@ -1150,18 +1580,14 @@ type unionQuery struct {
 func (u *unionQuery) Select(t iterator) NodeNavigator {
 	if u.iterator == nil {
 		var list []NodeNavigator
-		var m = make(map[uint64]bool)
 		root := t.Current().Copy()
 		for {
 			node := u.Left.Select(t)
 			if node == nil {
 				break
 			}
-			code := getHashCode(node.Copy())
-			if _, ok := m[code]; !ok {
-				m[code] = true
-				list = append(list, node.Copy())
-			}
+			buffer(t)
+			list = append(list, node.Copy())
 		}
 		t.Current().MoveTo(root)
 		for {
@@ -1169,12 +1595,11 @@ func (u *unionQuery) Select(t iterator) NodeNavigator {
 			if node == nil {
 				break
 			}
-			code := getHashCode(node.Copy())
-			if _, ok := m[code]; !ok {
-				m[code] = true
-				list = append(list, node.Copy())
-			}
+			buffer(t)
+			list = append(list, node.Copy())
 		}
+		// Sorting removes the nodes selected by both operands.
+		list = sortNodes(list)
 		var i int
 		u.iterator = func() NodeNavigator {
 			if i >= len(list) {
@@ -1207,6 +1632,246 @@ func (u *unionQuery) Properties() queryProp {
 	return queryProps.Merge
 }
 
+// intersectQuery is an XPath 2.0 intersect expression, which selects the
+// nodes of Left that are also nodes of Right, or an except expression if
+// Except is set, which selects the nodes of Left that are not nodes of
+// Right. The nodes are compared by identity and returned in document order.
+type intersectQuery struct {
+	Left, Right query
+	Except      bool
+	iterator    func() NodeNavigator
+}
+
+func (q *intersectQuery) Select(t iterator) NodeNavigator {
+	if q.iterator == nil {
+		root := t.Current().Copy()
+		right := make(map[uint64]bool)
+		for node := q.Right.Select(t); node != nil; node = q.Right.Select(t) {
+			buffer(t)
+			right[getHashCode(node.Copy())] = true
+		}
+		t.Current().MoveTo(root)
+		var list []NodeNavigator
+		for node := q.Left.Select(t); node != nil; node = q.Left.Select(t) {
+			if right[getHashCode(node.Copy())] != q.Except {
+				buffer(t)
+				list = append(list, node.Copy())
+			}
+		}
+		list = sortNodes(list)
+		var i int
+		q.iterator = func() NodeNavigator {
+			if i >= len(list) {
+				return nil
+			}
+			node := list[i]
+			i++
+			return node
+		}
+	}
+	return q.iterator()
+}
+
+func (q *intersectQuery) Evaluate(t iterator) interface{} {
+	q.iterator = nil
+	q.Left.Evaluate(t)
+	q.Right.Evaluate(t)
+	return q
+}
+
+func (q *intersectQuery) Clone() query {
+	return &intersectQuery{Left: q.Left.Clone(), Right: q.Right.Clone(), Except: q.Except}
+}
+
+func (q *intersectQuery) ValueType() resultType {
+	return xpathResultType.NodeSet
+}
+
+func (q *intersectQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// documentOrderQuery returns the nodes of Input in document order, without
+// duplicates. It is used for the location paths whose steps can select the
+// nodes out of order, such as the ancestor axis or a parent step.
+type documentOrderQuery struct {
+	list     []NodeNavigator
+	posit    int
+	buffered bool
+
+	Input query
+}
+
+func (d *documentOrderQuery) Select(t iterator) NodeNavigator {
+	if !d.buffered {
+		d.buffered = true
+		for node := d.Input.Select(t); node != nil; node = d.Input.Select(t) {
+			buffer(t)
+			d.list = append(d.list, node.Copy())
+		}
+		d.list = sortNodes(d.list)
+	}
+	if d.posit >= len(d.list) {
+		return nil
+	}
+	d.posit++
+	return d.list[d.posit-1]
+}
+
+func (d *documentOrderQuery) Evaluate(t iterator) interface{} {
+	d.Input.Evaluate(t)
+	d.list, d.posit, d.buffered = nil, 0, false
+	return d
+}
+
+func (d *documentOrderQuery) Clone() query {
+	return &documentOrderQuery{Input: d.Input.Clone()}
+}
+
+func (d *documentOrderQuery) ValueType() resultType {
+	return xpathResultType.NodeSet
+}
+
+func (d *documentOrderQuery) Properties() queryProp {
+	return queryProps.Position | queryProps.Count | queryProps.Cached | queryProps.Merge
+}
+
+func (d *documentOrderQuery) position() int {
+	return d.posit
+}
+
+// The order of the nodes selected by a query, from the strongest.
+const (
+	orderSingle  = iota // at most one node
+	orderFlat           // in document order, and no node is an ancestor of another
+	orderOrdered        // in document order
+	orderNone           // maybe out of order or with duplicates
+)
+
+// nodeOrder returns the order of the nodes selected by q. A query that is
+// not a location path keeps the order of its result.
+func nodeOrder(q query) int {
+	switch q := q.(type) {
+	case *contextQuery, *absoluteQuery:
+		return orderSingle
+	case *childQuery:
+		return childOrder(q.Input)
+	case *cachedChildQuery:
+		return childOrder(q.Input)
+	case *attributeQuery:
+		return attributeOrder(q.Input)
+	case *namespaceQuery:
+		return attributeOrder(q.Input)
+	case *descendantQuery:
+		return subtreeOrder(q.Input, orderOrdered)
+	case *descendantChildQuery:
+		return subtreeOrder(q.Input, orderOrdered)
+	case *descendantOverDescendantQuery:
+		return subtreeOrder(q.Input, orderOrdered)
+	case *selfQuery:
+		return nodeOrder(q.Input)
+	case *contextItemQuery:
+		return nodeOrder(q.Self)
+	case *filterQuery:
+		return nodeOrder(q.Input)
+	case *parentQuery:
+		if nodeOrder(q.Input) == orderSingle {
+			return orderSingle
+		}
+		if q.Siblings != nil {
+			// The parents of a child step are its input nodes, once each.
+			switch input := q.Input.(type) {
+			case *childQuery:
+				return nodeOrder(input.Input)
+			case *cachedChildQuery:
+				return nodeOrder(input.Input)
+			}
+		}
+		return orderNone
+	case *followingQuery:
+		if nodeOrder(q.Input) != orderSingle {
+			return orderNone
+		}
+		if q.Sibling {
+			return orderFlat
+		}
+		return orderOrdered
+	case *ancestorQuery, *precedingQuery:
+		return orderNone
+	case *mergeQuery:
+		if nodeOrder(q.Input) == orderSingle {
+			return nodeOrder(q.Child)
+		}
+		if isDescendantStep(q.Input) && nodeOrder(q.Child) <= orderFlat {
+			return orderOrdered
+		}
+		return orderNone
+	}
+	return orderOrdered
+}
+
+// childOrder returns the order of a child step over input. The children of
+// the nodes of a descendant step, filtered or not, are taken to be in
+// document order so that the step is not buffered; only the children of
+// nested parents can then be out of order. //a/b itself is built as a
+// descendantChildQuery, which keeps them in order.
+func childOrder(input query) int {
+	if isDescendantStep(input) {
+		return orderOrdered
+	}
+	return subtreeOrder(input, orderFlat)
+}
+
+// attributeOrder returns the order of an attribute or namespace step over
+// input. Those nodes have no children, so they are in order whenever their
+// parents are.
+func attributeOrder(input query) int {
+	if nodeOrder(input) == orderNone {
+		return orderNone
+	}
+	return orderFlat
+}
+
+// isDescendantStep reports whether q is a descendant step, or a child step
+// over one, that walks the subtree of a single context node or of nodes
+// that are not nested.
+func isDescendantStep(q query) bool {
+	for {
+		f, ok := q.(*filterQuery)
+		if !ok {
+			break
+		}
+		q = f.Input
+	}
+	switch q := q.(type) {
+	case *descendantQuery, *descendantChildQuery, *descendantOverDescendantQuery:
+		return nodeOrder(q) <= orderOrdered
+	case *childQuery:
+		return isDescendantStep(q.Input)
+	case *cachedChildQuery:
+		return isDescendantStep(q.Input)
+	}
+	return false
+}
+
+// subtreeOrder returns the order of a step that selects nodes within the
+// subtree of each input node, and in the order step for a single node.
+func subtreeOrder(input query, step int) int {
+	if nodeOrder(input) <= orderFlat {
+		return step
+	}
+	return orderNone
+}
+
+// inDocumentOrder wraps the location path q to return its nodes in
+// document order, if they may be out of order.
+func inDocumentOrder(q query) query {
+	if nodeOrder(q) == orderNone {
+		return &documentOrderQuery{Input: q}
+	}
+	return q
+}
+
 type lastFuncQuery struct {
 	buffer  []NodeNavigator
 	counted bool
@@ -1225,6 +1890,7 @@ func (q *lastFuncQuery) Evaluate(t iterator) interface{} {
 			if node == nil {
 				break
 			}
+			buffer(t)
 			q.buffer = append(q.buffer, node.Copy())
 		}
 		q.counted = true
@@ -1283,15 +1949,19 @@ func (d *descendantOverDescendantQuery) Select(t iterator) NodeNavigator {
 			}
 			d.currentNode = node.Copy()
 			d.posit = 0
-			if d.MatchSelf && d.Predicate(d.currentNode) {
-				d.posit = 1
-				return d.currentNode
+			if d.MatchSelf {
+				visit(t)
+				if d.Predicate(d.currentNode) {
+					d.posit = 1
+					return d.currentNode
+				}
 			}
 			d.moveToFirstChild()
 		} else if !d.moveUpUntilNext() {
 			continue
 		}
 		for ok := true; ok; ok = d.moveToFirstChild() {
+			visit(t)
 			if d.Predicate(d.currentNode) {
 				d.posit++
 				return d.currentNode
@@ -1340,6 +2010,7 @@ func (m *mergeQuery) Select(t iterator) NodeNavigator {
 			t.Current().MoveTo(root)
 			var list []NodeNavigator
 			for node := m.Child.Select(t); node != nil; node = m.Child.Select(t) {
+				buffer(t)
 				list = append(list, node.Copy())
 			}
 			i := 0
@@ -1381,7 +2052,7 @@ func (m *mergeQuery) Properties() queryProp {
 func getHashCode(n NodeNavigator) uint64 {
 	var sb bytes.Buffer
 	switch n.NodeType() {
-	case AttributeNode, TextNode, CommentNode:
+	case AttributeNode, TextNode, CommentNode, ProcessingInstructionNode, NamespaceNode:
 		sb.WriteString(n.LocalName())
 		sb.WriteByte('=')
 		sb.WriteString(n.Value())
@@ -1423,6 +2094,260 @@ func getHashCode(n NodeNavigator) uint64 {
 	return h.Sum64()
 }
 
+// nodeIdentifier is implemented by a navigator that has its own node
+// identifiers. NodeID returns a string of ASCII letters and digits that
+// identifies the current node among the nodes of all the documents.
+type nodeIdentifier interface {
+	NodeID() string
+}
+
+// nodeIdentity returns a string of ASCII letters and digits that
+// identifies the node n during the evaluation of t. A navigator can provide
+// its own identifiers by implementing NodeID() string. Otherwise the
+// identifier is the index of the document of n, followed by the position
+// of n in the document, like the path built by getHashCode, each step
+// prefixed with x.
+func nodeIdentity(t iterator, n NodeNavigator) string {
+	if id, ok := n.(nodeIdentifier); ok {
+		return id.NodeID()
+	}
+	var sb bytes.Buffer
+	sb.WriteString(strconv.Itoa(documentIndex(t, n)))
+	for _, step := range nodeOrderPath(n) {
+		sb.WriteByte('x')
+		switch {
+		case step < math.MinInt32/2:
+			sb.WriteByte('n')
+			step -= math.MinInt32
+		case step < 0:
+			sb.WriteByte('a')
+			step -= math.MinInt32 / 2
+		}
+		sb.WriteString(strconv.Itoa(step))
+	}
+	return sb.String()
+}
+
+// documentIndex returns the index of the document of n among the
+// documents met by the evaluation of t, or 0 if t does not keep them.
+func documentIndex(t iterator, n NodeNavigator) int {
+	type documents interface {
+		documentIndex(NodeNavigator) int
+	}
+	if d, ok := t.(documents); ok {
+		return d.documentIndex(n)
+	}
+	return 0
+}
+
+// nodeComparer is implemented by a navigator that can compare the
+// positions of two of its nodes faster than by walking the document.
+// Compare returns -1 if the current node is before other in document order,
+// 0 if they are the same node and +1 if it is after other.
+type nodeComparer interface {
+	Compare(other NodeNavigator) int
+}
+
+// sameDocument reports whether the nodes a and b are of the same document,
+// that is whether a navigator can move from the root of one to the root of
+// the other.
+func sameDocument(a, b NodeNavigator) bool {
+	a, b = a.Copy(), b.Copy()
+	a.MoveToRoot()
+	b.MoveToRoot()
+	return a.MoveTo(b)
+}
+
+// compareNodes compares the positions of the nodes a and b of the same
+// document. It returns -1 if a is before b in document order, 0 if they
+// are the same node and +1 if a is after b.
+func compareNodes(a, b NodeNavigator) int {
+	if c, ok := a.(nodeComparer); ok {
+		return c.Compare(b)
+	}
+	return comparePaths(nodeOrderPath(a), nodeOrderPath(b))
+}
+
+// comparePaths compares two paths returned by nodeOrderPath.
+func comparePaths(pa, pb []int) int {
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
+// sortNodes sorts list into document order and removes the duplicate
+// nodes, returning the sorted list.
+func sortNodes(list []NodeNavigator) []NodeNavigator {
+	if len(list) < 2 {
+		return list
+	}
+	n := 1
+	if _, ok := list[0].(nodeComparer); ok {
+		sort.SliceStable(list, func(i, j int) bool {
+			return compareNodes(list[i], list[j]) < 0
+		})
+		for i := 1; i < len(list); i++ {
+			if compareNodes(list[n-1], list[i]) != 0 {
+				list[n] = list[i]
+				n++
+			}
+		}
+		return list[:n]
+	}
+	// Walk the document once per node rather than once per comparison. The
+	// nodes of different documents are ordered by their documents, as met.
+	s := nodesByPath{list, make([]int, len(list)), make([][]int, len(list))}
+	var roots []NodeNavigator
+	var indexes map[string]int
+	if _, ok := list[0].(nodeIdentifier); ok {
+		indexes = make(map[string]int)
+	}
+	for i, node := range list {
+		path, root := orderPath(node, indexes)
+		d := 0
+		// A root moved to the root of the same document stays in place.
+		for d < len(roots) && !roots[d].MoveTo(root) {
+			d++
+		}
+		if d == len(roots) {
+			roots = append(roots, root)
+		}
+		s.docs[i], s.paths[i] = d, path
+	}
+	sort.Stable(s)
+	for i := 1; i < len(list); i++ {
+		if s.compare(n-1, i) != 0 {
+			list[n], s.docs[n], s.paths[n] = list[i], s.docs[i], s.paths[i]
+			n++
+		}
+	}
+	return list[:n]
+}
+
+// nodesByPath sorts nodes by the index of their document and their path.
+type nodesByPath struct {
+	list  []NodeNavigator
+	docs  []int
+	paths [][]int
+}
+
+func (s nodesByPath) Len() int { return len(s.list) }
+
+func (s nodesByPath) Less(i, j int) bool { return s.compare(i, j) < 0 }
+
+func (s nodesByPath) Swap(i, j int) {
+	s.list[i], s.list[j] = s.list[j], s.list[i]
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+}
+
+func (s nodesByPath) compare(i, j int) int {
+	if s.docs[i] != s.docs[j] {
+		if s.docs[i] < s.docs[j] {
+			return -1
+		}
+		return 1
+	}
+	return comparePaths(s.paths[i], s.paths[j])
+}
+
+// nodeOrderPath returns the path of n from the root of its document. Each
+// step is the index of a node among its siblings. The steps of namespace
+// and attribute nodes are negative, so the namespaces of an element come
+// before its attributes, which come before its children.
+func nodeOrderPath(n NodeNavigator) []int {
+	path, _ := orderPath(n, nil)
+	return path
+}
+
+// orderPath returns the nodeOrderPath of n and the root of its document.
+// If indexes is not nil, it keeps the sibling indexes found by NodeID, and
+// is looked up to stop the walks early.
+func orderPath(n NodeNavigator, indexes map[string]int) ([]int, NodeNavigator) {
+	n = n.Copy()
+	var path []int
+	switch n.NodeType() {
+	case NamespaceNode:
+		prefix := n.LocalName()
+		n.MoveToParent()
+		i := 0
+		if m, ok := n.Copy().(namespaceNavigator); ok {
+			for ; m.MoveToNextNamespace(); i++ {
+				if m.(NodeNavigator).LocalName() == prefix {
+					break
+				}
+			}
+		}
+		path = append(path, math.MinInt32+i)
+	case AttributeNode:
+		attr := n.Copy()
+		n.MoveToParent()
+		i := 0
+		for m := n.Copy(); m.MoveToNextAttribute(); i++ {
+			if m.LocalName() == attr.LocalName() && m.Prefix() == attr.Prefix() {
+				break
+			}
+		}
+		path = append(path, math.MinInt32/2+i)
+	}
+	for {
+		d := siblingIndex(n, indexes)
+		if !n.MoveToParent() {
+			break
+		}
+		path = append(path, d)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, n
+}
+
+// siblingIndex returns the index of n among its siblings, moving n to one
+// of its previous siblings. If indexes is not nil, the walk stops at the
+// first sibling whose index is known, and the indexes of the siblings
+// walked past are added to it.
+func siblingIndex(n NodeNavigator, indexes map[string]int) int {
+	if indexes == nil {
+		i := 0
+		for n.MoveToPrevious() {
+			i++
+		}
+		return i
+	}
+	// seen holds the identifiers of the siblings walked past, from n.
+	var seen []string
+	i := -1
+	for {
+		id := n.(nodeIdentifier).NodeID()
+		if known, ok := indexes[id]; ok {
+			i = known
+			break
+		}
+		seen = append(seen, id)
+		if !n.MoveToPrevious() {
+			break
+		}
+	}
+	i += len(seen)
+	for j, id := range seen {
+		indexes[id] = i - j
+	}
+	return i
+}
+
 func getNodePosition(q query) int {
 	type Position interface {
 		position() int
@@ -1443,6 +2368,92 @@ func getNodeDepth(q query) int {
 	return 0
 }
 
+// visit is called for each node visited by an axis or buffered by a
+// query, so the evaluation can be stopped.
+func visit(t iterator) {
+	type visitor interface {
+		visit()
+	}
+	if v, ok := t.(visitor); ok {
+		v.visit()
+	}
+}
+
+// buffer is called for each node copied into a buffer by a query, so the
+// number of buffered nodes can be limited.
+func buffer(t iterator) {
+	type bufferer interface {
+		buffer()
+	}
+	if b, ok := t.(bufferer); ok {
+		b.buffer()
+	}
+}
+
+// checkString stops the evaluation if the string s built by a function is
+// longer than allowed.
+func checkString(t iterator, s string) string {
+	checkLength(t, len(s))
+	return s
+}
+
+// checkLength stops the evaluation if a string being built by a function
+// has grown to n bytes, more than the iterator allows.
+func checkLength(t iterator, n int) {
+	type lengthChecker interface {
+		checkLength(int)
+	}
+	if c, ok := t.(lengthChecker); ok {
+		c.checkLength(n)
+	}
+}
+
+// checkSequence stops the evaluation if a sequence being built by a query
+// has grown to n items, more than the iterator allows.
+func checkSequence(t iterator, n int) {
+	type sequenceChecker interface {
+		checkSequence(int)
+	}
+	if c, ok := t.(sequenceChecker); ok {
+		c.checkSequence(n)
+	}
+}
+
+// getVariable returns the value of the variable name bound on the iterator.
+func getVariable(t iterator, name string) (interface{}, bool) {
+	type variables interface {
+		variable(string) (interface{}, bool)
+	}
+	if v, ok := t.(variables); ok {
+		return v.variable(name)
+	}
+	return nil, false
+}
+
+// contextItem returns the context item of the right operand of a !
+// expression, if it is an atomic value.
+func contextItem(t iterator) (interface{}, bool) {
+	type contextItems interface {
+		contextItem() (interface{}, bool)
+	}
+	if c, ok := t.(contextItems); ok {
+		return c.contextItem()
+	}
+	return nil, false
+}
+
+// isStrict reports whether the values are converted with the exact XPath
+// 1.0 rules.
+func isStrict(t iterator) bool {
+	type strictMode interface {
+		strictMode() bool
+	}
+	if s, ok := t.(strictMode); ok {
+		return s.strictMode()
+	}
+	return false
+}
+
 func getXPathType(i interface{}) resultType {
 	v := reflect.ValueOf(i)
 	switch v.Kind() {
@@ -1452,6 +2463,10 @@ func getXPathType(i interface{}) resultType {
 		return xpathResultType.String
 	case reflect.Bool:
 		return xpathResultType.Boolean
+	case reflect.Slice:
+		if _, ok := i.(Sequence); ok {
+			return xpathResultType.Sequence
+		}
 	default:
 		if _, ok := i.(query); ok {
 			return xpathResultType.NodeSet
@@ -0,0 +1,763 @@
+package xpath
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Item is an item of a Sequence: a node or an atomic value.
+type Item struct {
+	// Node is the node of a node item, or nil for an atomic value.
+	Node NodeNavigator
+
+	// Value is the atomic value, a string, float64 or bool. It is nil for
+	// a node item.
+	Value interface{}
+}
+
+// IsNode reports whether the item is a node.
+func (it Item) IsNode() bool {
+	return it.Node != nil
+}
+
+// String returns the string value of the item.
+func (it Item) String() string {
+	if it.Node != nil {
+		return it.Node.Value()
+	}
+	return asString(nil, it.Value)
+}
+
+// atomize returns the atomic value of the item. The atomic value of a node
+// is its string value.
+func (it Item) atomize() interface{} {
+	if it.Node != nil {
+		return it.Node.Value()
+	}
+	return it.Value
+}
+
+// variableValue returns the item as the value of a variable: a node-set of
+// one node, or the atomic value.
+func (it Item) variableValue() interface{} {
+	if it.Node != nil {
+		return []NodeNavigator{it.Node}
+	}
+	return it.Value
+}
+
+// Sequence is an ordered list of nodes and atomic values, as in the XPath
+// 2.0 data model. Expr.Evaluate returns a Sequence for a sequence that
+// holds atomic values, such as (1, 'a', //b); a sequence of nodes only is
+// a node-set.
+type Sequence []Item
+
+// asSequence converts the value v to a sequence. A node-set is a sequence of
+// nodes, and a string, number or boolean a sequence of one atomic value.
+func asSequence(t iterator, v interface{}) Sequence {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case Sequence:
+		return v
+	case query:
+		var seq Sequence
+		for node := v.Select(t); node != nil; node = v.Select(t) {
+			buffer(t)
+			seq = append(seq, Item{Node: node.Copy()})
+		}
+		return seq
+	default:
+		return Sequence{{Value: v}}
+	}
+}
+
+// effectiveBool returns the effective boolean value of the sequence seq: false
+// if it is empty, true if its first item is a node, and the boolean value of
+// its only item otherwise.
+func (seq Sequence) effectiveBool() bool {
+	switch {
+	case len(seq) == 0:
+		return false
+	case seq[0].Node != nil:
+		return true
+	case len(seq) > 1:
+		panic(errors.New("xpath: the effective boolean value of a sequence of several atomic values is not defined"))
+	}
+	return asBool(nil, seq[0].Value)
+}
+
+// sequenceResult holds the items of an evaluated query whose value is a
+// sequence. A sequence of nodes only is a node-set, whose nodes are selected
+// in the order of the items.
+type sequenceResult struct {
+	list      Sequence
+	posit     int
+	evaluated bool
+}
+
+// set sets the items of the result to seq, and returns the value of q: q if
+// the items are all nodes, and seq otherwise.
+func (r *sequenceResult) set(q query, seq Sequence) interface{} {
+	r.list, r.posit, r.evaluated = seq, 0, true
+	for _, item := range seq {
+		if item.Node == nil {
+			return seq
+		}
+	}
+	return q
+}
+
+// next returns the next node of the result of q, evaluating q first if
+// needed.
+func (r *sequenceResult) next(q query, t iterator) NodeNavigator {
+	if !r.evaluated {
+		q.Evaluate(t)
+	}
+	if r.posit >= len(r.list) {
+		return nil
+	}
+	node := r.list[r.posit].Node
+	if node == nil {
+		panic(errors.New("xpath: a sequence of atomic values is not a node-set"))
+	}
+	r.posit++
+	return node
+}
+
+func (r *sequenceResult) position() int {
+	return r.posit
+}
+
+// sequenceQuery is an XPath 2.0 sequence expression (a, b, ...), the
+// concatenation of the values of its operands.
+type sequenceQuery struct {
+	sequenceResult
+
+	Items []query
+}
+
+func (s *sequenceQuery) Select(t iterator) NodeNavigator {
+	return s.next(s, t)
+}
+
+func (s *sequenceQuery) Evaluate(t iterator) interface{} {
+	var seq Sequence
+	root := t.Current().Copy()
+	for _, q := range s.Items {
+		seq = append(seq, asSequence(t, q.Evaluate(t))...)
+		checkSequence(t, len(seq))
+		t.Current().MoveTo(root)
+	}
+	return s.set(s, seq)
+}
+
+func (s *sequenceQuery) Clone() query {
+	items := make([]query, len(s.Items))
+	for i, q := range s.Items {
+		items[i] = q.Clone()
+	}
+	return &sequenceQuery{Items: items}
+}
+
+func (s *sequenceQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (s *sequenceQuery) Properties() queryProp {
+	return queryProps.Position | queryProps.Count | queryProps.Cached | queryProps.Merge
+}
+
+// forQuery is an XPath 2.0 for expression, the concatenation of the values
+// of Return evaluated for each item of In, with the item bound to the
+// variable Name.
+type forQuery struct {
+	sequenceResult
+
+	Name       string
+	In, Return query
+}
+
+func (f *forQuery) Select(t iterator) NodeNavigator {
+	return f.next(f, t)
+}
+
+func (f *forQuery) Evaluate(t iterator) interface{} {
+	var seq Sequence
+	root := t.Current().Copy()
+	next := items(t, f.In)
+	for item, ok := next(); ok; item, ok = next() {
+		t.Current().MoveTo(root)
+		scope := newScope(t, f.Name, item.variableValue())
+		seq = append(seq, asSequence(scope, f.Return.Evaluate(scope))...)
+		checkSequence(t, len(seq))
+	}
+	t.Current().MoveTo(root)
+	return f.set(f, seq)
+}
+
+func (f *forQuery) Clone() query {
+	return &forQuery{Name: f.Name, In: f.In.Clone(), Return: f.Return.Clone()}
+}
+
+func (f *forQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (f *forQuery) Properties() queryProp {
+	return queryProps.Position | queryProps.Count | queryProps.Cached | queryProps.Merge
+}
+
+// mapQuery is an XPath 3.0 simple map expression a ! b, the concatenation
+// of the values of Right evaluated for each item of Left, with the item as
+// the context item.
+type mapQuery struct {
+	sequenceResult
+
+	Left, Right query
+}
+
+func (m *mapQuery) Select(t iterator) NodeNavigator {
+	return m.next(m, t)
+}
+
+func (m *mapQuery) Evaluate(t iterator) interface{} {
+	var seq Sequence
+	root := t.Current().Copy()
+	for _, item := range asSequence(t, m.Left.Evaluate(t)) {
+		if item.IsNode() {
+			t.Current().MoveTo(item.Node)
+		} else {
+			t.Current().MoveTo(root)
+		}
+		scope := newItemScope(t, item)
+		seq = append(seq, asSequence(scope, m.Right.Evaluate(scope))...)
+		checkSequence(t, len(seq))
+	}
+	t.Current().MoveTo(root)
+	return m.set(m, seq)
+}
+
+func (m *mapQuery) Clone() query {
+	return &mapQuery{Left: m.Left.Clone(), Right: m.Right.Clone()}
+}
+
+func (m *mapQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (m *mapQuery) Properties() queryProp {
+	return queryProps.Position | queryProps.Count | queryProps.Cached | queryProps.Merge
+}
+
+// quantifiedQuery is an XPath 2.0 some or every expression, which is true
+// if Satisfies is true for some or every item of In, bound to the variable
+// Name.
+type quantifiedQuery struct {
+	Every         bool
+	Name          string
+	In, Satisfies query
+}
+
+func (q *quantifiedQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (q *quantifiedQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	defer t.Current().MoveTo(root)
+	next := items(t, q.In)
+	for item, ok := next(); ok; item, ok = next() {
+		t.Current().MoveTo(root)
+		scope := newScope(t, q.Name, item.variableValue())
+		if asBool(scope, q.Satisfies.Evaluate(scope)) != q.Every {
+			return !q.Every
+		}
+	}
+	return q.Every
+}
+
+func (q *quantifiedQuery) Clone() query {
+	return &quantifiedQuery{Every: q.Every, Name: q.Name, In: q.In.Clone(), Satisfies: q.Satisfies.Clone()}
+}
+
+func (q *quantifiedQuery) ValueType() resultType {
+	return xpathResultType.Boolean
+}
+
+func (q *quantifiedQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// letQuery is an XPath 3.0 let expression, the value of Return with the
+// value of Value bound to the variable Name. Value is evaluated once for
+// each evaluation of the expression, however many times Return references
+// the variable.
+type letQuery struct {
+	Name          string
+	Value, Return query
+
+	value interface{} // the bound value
+	nodes query       // the node-set value of Return
+}
+
+func (l *letQuery) Select(t iterator) NodeNavigator {
+	if l.nodes == nil {
+		if _, ok := l.Evaluate(t).(query); !ok {
+			panic(errors.New("xpath: the value of the let expression is not a node-set"))
+		}
+	}
+	// The nodes can be selected lazily, and so need the variable.
+	return l.nodes.Select(newScope(t, l.Name, l.value))
+}
+
+func (l *letQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	l.value, l.nodes = l.Value.Evaluate(t), nil
+	if q, ok := l.value.(query); ok {
+		list := []NodeNavigator{}
+		for node := q.Select(t); node != nil; node = q.Select(t) {
+			buffer(t)
+			list = append(list, node.Copy())
+		}
+		l.value = list
+	}
+	t.Current().MoveTo(root)
+	v := l.Return.Evaluate(newScope(t, l.Name, l.value))
+	if nodes, ok := v.(query); ok {
+		l.nodes = nodes
+		return l
+	}
+	return v
+}
+
+func (l *letQuery) Clone() query {
+	return &letQuery{Name: l.Name, Value: l.Value.Clone(), Return: l.Return.Clone()}
+}
+
+func (l *letQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (l *letQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// rangeQuery is an XPath 2.0 range expression, the sequence of the
+// integers from Left to Right. The sequence is empty if an operand is
+// empty or Left is greater than Right.
+type rangeQuery struct {
+	Left, Right query
+}
+
+func (r *rangeQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (r *rangeQuery) Evaluate(t iterator) interface{} {
+	it := r.iterate(t)
+	if n := it.end - it.cursor + 1; n > 0 {
+		checkSequence(t, int(math.Min(n, math.MaxInt32)))
+	}
+	seq := Sequence{}
+	for item, ok := it.next(t); ok; item, ok = it.next(t) {
+		seq = append(seq, item)
+	}
+	return seq
+}
+
+// iterate evaluates the operands and returns an iterator over the integers
+// of the range.
+func (r *rangeQuery) iterate(t iterator) *rangeIterator {
+	root := t.Current().Copy()
+	from, ok := rangeBound(t, r.Left.Evaluate(t))
+	t.Current().MoveTo(root)
+	to, ok2 := rangeBound(t, r.Right.Evaluate(t))
+	t.Current().MoveTo(root)
+	if !ok || !ok2 {
+		return &rangeIterator{cursor: 1, end: 0}
+	}
+	return &rangeIterator{cursor: from, end: to}
+}
+
+func (r *rangeQuery) Clone() query {
+	return &rangeQuery{Left: r.Left.Clone(), Right: r.Right.Clone()}
+}
+
+func (r *rangeQuery) ValueType() resultType {
+	return xpathResultType.Sequence
+}
+
+func (r *rangeQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// maxRangeBound is the greatest integer a range can count to exactly.
+const maxRangeBound = 1 << 53
+
+// rangeIterator generates the integers from cursor to end.
+type rangeIterator struct {
+	cursor, end float64
+}
+
+// next returns the next integer of the range, and false at the end of it.
+func (r *rangeIterator) next(t iterator) (Item, bool) {
+	if r.cursor > r.end {
+		return Item{}, false
+	}
+	r.cursor++
+	return Item{Value: r.cursor - 1}, true
+}
+
+// rangeBound converts the operand v of a range expression to an integer. It
+// returns false if v is an empty sequence.
+func rangeBound(t iterator, v interface{}) (float64, bool) {
+	item, ok := singleItem(t, v, "the range expression")
+	if !ok {
+		return 0, false
+	}
+	f := asNumber(t, item.atomize())
+	if math.IsNaN(f) || math.IsInf(f, 0) || f != math.Trunc(f) {
+		panic(fmt.Errorf("xpath: an operand of the range expression is not an integer: %s", item))
+	}
+	if math.Abs(f) > maxRangeBound {
+		panic(fmt.Errorf("xpath: an operand of the range expression is out of range: %s", item))
+	}
+	return f, true
+}
+
+// rangeItemQuery is a range expression filtered by a number, (a to b)[n],
+// the nth integer of the range. The range is not built.
+type rangeItemQuery struct {
+	Range    *rangeQuery
+	Position float64
+}
+
+func (r *rangeItemQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (r *rangeItemQuery) Evaluate(t iterator) interface{} {
+	it := r.Range.iterate(t)
+	v := it.cursor + r.Position - 1
+	if r.Position < 1 || r.Position != math.Trunc(r.Position) || v > it.end {
+		return Sequence{}
+	}
+	return Sequence{{Value: v}}
+}
+
+func (r *rangeItemQuery) Clone() query {
+	return &rangeItemQuery{Range: r.Range.Clone().(*rangeQuery), Position: r.Position}
+}
+
+func (r *rangeItemQuery) ValueType() resultType {
+	return xpathResultType.Sequence
+}
+
+func (r *rangeItemQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// rangeCompareQuery is a general comparison Value op Range whose right
+// operand is a range expression, such as position() = 2 to 5. The items of
+// Value are compared with the bounds of the range, which is not built.
+type rangeCompareQuery struct {
+	Op    string
+	Value query
+	Range *rangeQuery
+}
+
+func (r *rangeCompareQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (r *rangeCompareQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	seq := asSequence(t, r.Value.Evaluate(t))
+	t.Current().MoveTo(root)
+	it := r.Range.iterate(t)
+	if it.cursor > it.end {
+		return false
+	}
+	for _, item := range seq {
+		if r.compare(t, item.atomize(), it.cursor, it.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare reports whether v op i is true for an integer i from lo to hi.
+func (r *rangeCompareQuery) compare(t iterator, v interface{}, lo, hi float64) bool {
+	var x float64
+	switch v := v.(type) {
+	case bool:
+		if r.Op == "=" || r.Op == "!=" {
+			// The integers are converted to booleans: 0 is false and any
+			// other integer is true.
+			return (lo <= 0 && hi >= 0 && cmpBooleanBooleanF(r.Op, v, false)) ||
+				((lo != 0 || hi != 0) && cmpBooleanBooleanF(r.Op, v, true))
+		}
+		x = boolToNumber(v)
+	case string:
+		x = toNumber(t, v)
+	default:
+		x = asNumber(t, v)
+	}
+	switch r.Op {
+	case "=":
+		return x >= lo && x <= hi && x == math.Trunc(x)
+	case "!=":
+		return lo != hi || x != lo
+	case "<":
+		return x < hi
+	case "<=":
+		return x <= hi
+	case ">":
+		return x > lo
+	case ">=":
+		return x >= lo
+	}
+	return false
+}
+
+func (r *rangeCompareQuery) Clone() query {
+	return &rangeCompareQuery{Op: r.Op, Value: r.Value.Clone(), Range: r.Range.Clone().(*rangeQuery)}
+}
+
+func (r *rangeCompareQuery) ValueType() resultType {
+	return xpathResultType.Boolean
+}
+
+func (r *rangeCompareQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// items returns a function that returns the items of the value of q one at
+// a time, and false after the last one. The integers of a range expression
+// are generated as they are returned rather than built first.
+func items(t iterator, q query) func() (Item, bool) {
+	if r, ok := q.(*rangeQuery); ok {
+		it := r.iterate(t)
+		return func() (Item, bool) {
+			return it.next(t)
+		}
+	}
+	seq := asSequence(t, q.Evaluate(t))
+	return func() (Item, bool) {
+		if len(seq) == 0 {
+			return Item{}, false
+		}
+		item := seq[0]
+		seq = seq[1:]
+		return item, true
+	}
+}
+
+// singleItem returns the only item of the operand v of the expression what.
+// It returns false if v is an empty sequence, and panics if v has more than
+// one item.
+func singleItem(t iterator, v interface{}, what string) (Item, bool) {
+	seq := asSequence(t, v)
+	switch len(seq) {
+	case 0:
+		return Item{}, false
+	case 1:
+		return seq[0], true
+	}
+	panic(fmt.Errorf("xpath: an operand of %s has more than one item", what))
+}
+
+// valueCompareQuery is an XPath 2.0 value comparison such as a eq b, which
+// compares two single atomic values. Its value is the empty sequence if an
+// operand is empty.
+type valueCompareQuery struct {
+	Op          string // the matching general comparison operator: =, !=, <, ...
+	Left, Right query
+}
+
+func (v *valueCompareQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (v *valueCompareQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	a, ok := singleItem(t, v.Left.Evaluate(t), "the value comparison")
+	t.Current().MoveTo(root)
+	b, ok2 := singleItem(t, v.Right.Evaluate(t), "the value comparison")
+	t.Current().MoveTo(root)
+	if !ok || !ok2 {
+		return Sequence{}
+	}
+	return compareValues(t, v.Op, a, b)
+}
+
+func (v *valueCompareQuery) Clone() query {
+	return &valueCompareQuery{Op: v.Op, Left: v.Left.Clone(), Right: v.Right.Clone()}
+}
+
+func (v *valueCompareQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (v *valueCompareQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// nodeCompareQuery is an XPath 2.0 node comparison: a is b, which is true if
+// a and b are the same node, or a << b and a >> b, which are true if a is
+// before or after b in document order. Its value is the empty sequence if
+// an operand is empty.
+type nodeCompareQuery struct {
+	Op          string // is, << or >>
+	Left, Right query
+}
+
+func (n *nodeCompareQuery) Select(t iterator) NodeNavigator {
+	return nil
+}
+
+func (n *nodeCompareQuery) Evaluate(t iterator) interface{} {
+	root := t.Current().Copy()
+	a, ok := singleNode(t, n.Left.Evaluate(t))
+	t.Current().MoveTo(root)
+	b, ok2 := singleNode(t, n.Right.Evaluate(t))
+	t.Current().MoveTo(root)
+	if !ok || !ok2 {
+		return Sequence{}
+	}
+	var c int
+	if sameDocument(a, b) {
+		c = compareNodes(a, b)
+	} else {
+		// The nodes of different documents are never the same node, and
+		// the documents are ordered as the evaluation meets them.
+		c = documentIndex(t, a) - documentIndex(t, b)
+		if c == 0 {
+			c = -1
+		}
+	}
+	switch n.Op {
+	case "<<":
+		return c < 0
+	case ">>":
+		return c > 0
+	}
+	return c == 0
+}
+
+func (n *nodeCompareQuery) Clone() query {
+	return &nodeCompareQuery{Op: n.Op, Left: n.Left.Clone(), Right: n.Right.Clone()}
+}
+
+func (n *nodeCompareQuery) ValueType() resultType {
+	return xpathResultType.Any
+}
+
+func (n *nodeCompareQuery) Properties() queryProp {
+	return queryProps.Merge
+}
+
+// singleNode returns the only node of the operand v of a node comparison. It
+// returns false if v is an empty sequence, and panics if v is not a single
+// node.
+func singleNode(t iterator, v interface{}) (NodeNavigator, bool) {
+	item, ok := singleItem(t, v, "the node comparison")
+	if ok && !item.IsNode() {
+		panic(fmt.Errorf("xpath: an operand of the node comparison is not a node: %s", item))
+	}
+	return item.Node, ok
+}
+
+// scopeIterator binds the variable of a for, quantified or let expression,
+// or the context item of a ! expression, on top of the iterator it wraps,
+// which keeps the context node and the other variables.
+type scopeIterator struct {
+	iterator
+	name  string
+	value interface{}
+	item  *Item // the context item, or nil if the scope binds a variable
+}
+
+// newScope returns t with the variable name bound to value.
+func newScope(t iterator, name string, value interface{}) *scopeIterator {
+	return &scopeIterator{iterator: t, name: name, value: value}
+}
+
+// newItemScope returns t with item as the context item. The context node
+// of t must be item, if item is a node.
+func newItemScope(t iterator, item Item) *scopeIterator {
+	return &scopeIterator{iterator: t, item: &item}
+}
+
+func (s *scopeIterator) contextItem() (interface{}, bool) {
+	if s.item == nil {
+		return contextItem(s.iterator)
+	}
+	if s.item.IsNode() {
+		return nil, false
+	}
+	return s.item.Value, true
+}
+
+func (s *scopeIterator) variable(name string) (interface{}, bool) {
+	if s.item == nil && name == s.name {
+		return s.value, true
+	}
+	return getVariable(s.iterator, name)
+}
+
+func (s *scopeIterator) visit() {
+	visit(s.iterator)
+}
+
+func (s *scopeIterator) buffer() {
+	buffer(s.iterator)
+}
+
+func (s *scopeIterator) checkLength(n int) {
+	checkLength(s.iterator, n)
+}
+
+func (s *scopeIterator) checkSequence(n int) {
+	checkSequence(s.iterator, n)
+}
+
+func (s *scopeIterator) strictMode() bool {
+	return isStrict(s.iterator)
+}
+
+func (s *scopeIterator) documentIndex(n NodeNavigator) int {
+	return documentIndex(s.iterator, n)
+}
+
+func (s *scopeIterator) keyCache() *KeyCache {
+	return getKeyCache(s.iterator)
+}
+
+// distinctValuesFunc is XPath functions distinct-values(sequence) function
+// operation. It returns the atomic values of the sequence without the
+// duplicates, in the order of their first occurrence.
+func distinctValuesFunc(arg query) func(query, iterator) interface{} {
+	return func(_ query, t iterator) interface{} {
+		seen := make(map[interface{}]bool)
+		nan := false
+		seq := Sequence{}
+		for _, item := range asSequence(t, functionArgs(arg).Evaluate(t)) {
+			v := item.atomize()
+			if f, ok := v.(float64); ok && math.IsNaN(f) {
+				// NaN is not equal to itself, but is a distinct value.
+				if nan {
+					continue
+				}
+				nan = true
+			} else if seen[v] {
+				continue
+			}
+			seen[v] = true
+			seq = append(seq, Item{Value: v})
+		}
+		return seq
+	}
+}
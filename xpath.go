@@ -1,8 +1,10 @@
 package xpath
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
 )
 
 // NodeType represents a type of XPath node.
@@ -24,6 +26,16 @@ const (
 	// CommentNode is a comment node, such as <!-- my comment -->
 	CommentNode
 
+	// ProcessingInstructionNode is a processing instruction, such as
+	// <?xml-stylesheet href="style.xsl"?>. Its LocalName is the target and
+	// its Value is the data.
+	ProcessingInstructionNode
+
+	// NamespaceNode is an in-scope namespace of an element, selected by the
+	// namespace axis. Its LocalName is the prefix and its Value is the
+	// namespace URI.
+	NamespaceNode
+
 	// allNode is any types of node, used by xpath package only to predicate match.
 	allNode
 )
@@ -72,8 +84,15 @@ type NodeNavigator interface {
 
 // NodeIterator holds all matched Node object.
 type NodeIterator struct {
-	node  NodeNavigator
-	query query
+	node   NodeNavigator
+	query  query
+	vars   map[string]interface{}
+	ctx    context.Context
+	budget *budget
+	strict bool
+	keys   *KeyCache
+	docs   []NodeNavigator
+	err    error
 }
 
 // Current returns current node which matched.
@@ -81,8 +100,58 @@ func (t *NodeIterator) Current() NodeNavigator {
 	return t.node
 }
 
-// MoveNext moves Navigator to the next match node.
+// MoveNext moves Navigator to the next match node. For an iterator
+// returned by SelectWithOptions or EvaluateWithOptions, MoveNext returns
+// false once the context of the options is done or a limit is exceeded,
+// and Err returns the error. It also returns false at once if a variable
+// referenced by the expression has no value.
 func (t *NodeIterator) MoveNext() bool {
+	if t.err != nil {
+		return false
+	}
+	if t.ctx != nil || t.budget != nil {
+		return t.moveNextChecked()
+	}
+	return t.moveNext()
+}
+
+func (t *NodeIterator) moveNextChecked() (ok bool) {
+	if t.err != nil {
+		return false
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err, stopped := t.stopError(e)
+			if !stopped {
+				panic(e)
+			}
+			t.err, ok = err, false
+		}
+	}()
+	t.checkDone()
+	if !t.moveNext() {
+		return false
+	}
+	if t.budget != nil {
+		t.budget.result()
+	}
+	return true
+}
+
+// stopError returns the error raised by e if it stopped the evaluation.
+func (t *NodeIterator) stopError(e interface{}) (error, bool) {
+	switch err := e.(type) {
+	case *LimitError:
+		return err, true
+	case error:
+		if t.ctx != nil && err == t.ctx.Err() {
+			return err, true
+		}
+	}
+	return nil, false
+}
+
+func (t *NodeIterator) moveNext() bool {
 	n := t.query.Select(t)
 	if n == nil {
 		return false
@@ -93,6 +162,98 @@ func (t *NodeIterator) MoveNext() bool {
 	return true
 }
 
+// Err returns the error that stopped the iteration, such as
+// context.Canceled, context.DeadlineExceeded, a *LimitError or a
+// *VariableError.
+func (t *NodeIterator) Err() error {
+	return t.err
+}
+
+// visit is called for each node tested by an axis. It stops the
+// evaluation once the context of the iterator is done or too many nodes
+// were visited.
+func (t *NodeIterator) visit() {
+	if t.budget != nil {
+		t.budget.visit()
+	}
+	t.checkDone()
+}
+
+// checkDone stops the evaluation once the context of the iterator is done.
+func (t *NodeIterator) checkDone() {
+	if t.ctx == nil {
+		return
+	}
+	select {
+	case <-t.ctx.Done():
+		panic(t.ctx.Err())
+	default:
+	}
+}
+
+// buffer is called for each node copied into a buffer by a query.
+func (t *NodeIterator) buffer() {
+	if t.budget != nil {
+		t.budget.buffer()
+	}
+}
+
+// checkLength is called with the length of each string built by a
+// function, as it grows.
+func (t *NodeIterator) checkLength(n int) {
+	if t.budget != nil {
+		t.budget.checkLength(n)
+	}
+}
+
+// checkSequence is called with the length of each sequence built by a
+// query, as it grows.
+func (t *NodeIterator) checkSequence(n int) {
+	max := defaultMaxSequenceLength
+	if t.budget != nil && t.budget.limits.MaxSequenceLength > 0 {
+		max = t.budget.limits.MaxSequenceLength
+	}
+	if n > max {
+		panic(&LimitError{Limit: "MaxSequenceLength", Max: max})
+	}
+}
+
+// strictMode reports whether the expression was compiled in strict mode,
+// where values are converted with the exact XPath 1.0 rules.
+func (t *NodeIterator) strictMode() bool {
+	return t.strict
+}
+
+// documentIndex returns the index of the document of n among the documents
+// met by the evaluation. Two nodes are of the same document if a navigator
+// can move from one to the other.
+func (t *NodeIterator) documentIndex(n NodeNavigator) int {
+	root := n.Copy()
+	root.MoveToRoot()
+	for i, doc := range t.docs {
+		if doc.Copy().MoveTo(root) {
+			return i
+		}
+	}
+	t.docs = append(t.docs, root)
+	return len(t.docs) - 1
+}
+
+// keyCache returns the cache of the indexes of the keys built by the
+// evaluation.
+func (t *NodeIterator) keyCache() *KeyCache {
+	if t.keys == nil {
+		t.keys = &KeyCache{}
+	}
+	return t.keys
+}
+
+// variable returns the value bound to the variable name.
+func (t *NodeIterator) variable(name string) (interface{}, bool) {
+	v, ok := t.vars[name]
+	return v, ok
+}
+
 // Select selects a node set using the specified XPath expression.
 // This method is deprecated, recommend using Expr.Select() method instead.
 func Select(root NodeNavigator, expr string) *NodeIterator {
@@ -105,30 +266,133 @@ func Select(root NodeNavigator, expr string) *NodeIterator {
 
 // Expr is an XPath expression for query.
 type Expr struct {
-	s string
-	q query
+	s      string
+	q      query
+	strict bool
+	vars   []string // the variables whose values are passed to the evaluation
 }
 
-type iteratorFunc func() NodeNavigator
+// Evaluate returns the result of the expression.
+// The result type of the expression is one of the follow: bool,float64,string,NodeIterator),
+// or a Sequence for a sequence that holds atomic values. Evaluate passes no
+// variable values, so it returns a *VariableError for an expression that
+// references a declared variable.
+func (expr *Expr) Evaluate(root NodeNavigator) interface{} {
+	if err := expr.unbound(nil); err != nil {
+		return err
+	}
+	return expr.evaluate(&NodeIterator{node: root, strict: expr.strict})
+}
 
-func (f iteratorFunc) Current() NodeNavigator {
-	return f()
+// EvaluateWithVars returns the result of the expression, using vars as
+// the values of the variables referenced by the expression. A value must be
+// a string, a number, a bool, a *NodeIterator, a []NodeNavigator, a
+// []string or a Sequence; other types panic, while EvaluateWithOptions
+// returns an error for them. If a referenced variable has no value in
+// vars, EvaluateWithVars returns a *VariableError.
+func (expr *Expr) EvaluateWithVars(root NodeNavigator, vars map[string]interface{}) interface{} {
+	if err := expr.unbound(vars); err != nil {
+		return err
+	}
+	return expr.evaluate(&NodeIterator{node: root, vars: bindVariables(vars), strict: expr.strict})
 }
 
-// Evaluate returns the result of the expression.
-// The result type of the expression is one of the follow: bool,float64,string,NodeIterator).
-func (expr *Expr) Evaluate(root NodeNavigator) interface{} {
-	val := expr.q.Evaluate(iteratorFunc(func() NodeNavigator { return root }))
+// evaluate evaluates the expression with the iterator t, which holds the
+// root node and the evaluation state.
+func (expr *Expr) evaluate(t *NodeIterator) interface{} {
+	val := expr.q.Evaluate(t)
 	switch val.(type) {
 	case query:
-		return &NodeIterator{query: expr.q.Clone(), node: root}
+		return &NodeIterator{query: expr.q.Clone(), node: t.node, vars: t.vars, ctx: t.ctx, budget: t.budget, strict: t.strict, keys: t.keys, docs: t.docs}
 	}
 	return val
 }
 
+// EvaluateSequence returns the result of the expression as a sequence. A
+// node-set is a sequence of nodes, and a string, number or boolean is a
+// sequence of one atomic value.
+func (expr *Expr) EvaluateSequence(root NodeNavigator) (seq Sequence, err error) {
+	if err := expr.unbound(nil); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			seq, err = nil, panicError(e)
+		}
+	}()
+	t := &NodeIterator{node: root, strict: expr.strict}
+	return asSequence(t, expr.q.Clone().Evaluate(t)), nil
+}
+
+// EvaluateWithOptions returns the result of the expression, using the
+// variable values, the evaluation limits and the context.Context of opts.
+// Unlike Evaluate, an error raised during the evaluation is returned
+// instead of panicking. The evaluation stops with opts.Context.Err() once
+// opts.Context is done, and a *NodeIterator result keeps checking it while
+// it is iterated; see NodeIterator.Err.
+func (expr *Expr) EvaluateWithOptions(root NodeNavigator, opts *Options) (val interface{}, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	t, err := expr.iterator(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			val, err = nil, panicError(e)
+		}
+	}()
+	return expr.evaluate(t), nil
+}
+
 // Select selects a node set using the specified XPath expression.
 func (expr *Expr) Select(root NodeNavigator) *NodeIterator {
-	return &NodeIterator{query: expr.q.Clone(), node: root}
+	return &NodeIterator{query: expr.q.Clone(), node: root, strict: expr.strict, err: expr.unbound(nil)}
+}
+
+// SelectWithOptions selects a node set using the specified XPath
+// expression, with the variable values, the evaluation limits and the
+// context.Context of opts. The returned iterator stops once opts.Context
+// is done or a limit is exceeded; its Err method then returns the error.
+func (expr *Expr) SelectWithOptions(root NodeNavigator, opts *Options) *NodeIterator {
+	if opts == nil {
+		opts = &Options{}
+	}
+	t, err := expr.iterator(root, opts)
+	if err != nil {
+		return &NodeIterator{query: expr.q, node: root, err: err}
+	}
+	t.query = expr.q.Clone()
+	return t
+}
+
+// iterator returns the iterator that evaluates the expression with the
+// options opts.
+func (expr *Expr) iterator(root NodeNavigator, opts *Options) (t *NodeIterator, err error) {
+	if opts.Context != nil {
+		if err := opts.Context.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := expr.unbound(opts.Variables); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			t, err = nil, panicError(e)
+		}
+	}()
+	return &NodeIterator{node: root, vars: bindVariables(opts.Variables), ctx: opts.Context, budget: newBudget(opts.Limits), strict: expr.strict, keys: opts.KeyCache}, nil
+}
+
+// SelectWithVars selects a node set using the specified XPath expression,
+// using vars as the values of the variables referenced by the expression.
+func (expr *Expr) SelectWithVars(root NodeNavigator, vars map[string]interface{}) *NodeIterator {
+	if err := expr.unbound(vars); err != nil {
+		return &NodeIterator{query: expr.q, node: root, err: err}
+	}
+	return &NodeIterator{query: expr.q.Clone(), node: root, vars: bindVariables(vars), strict: expr.strict}
 }
 
 // String returns XPath expression string.
@@ -138,17 +402,7 @@ func (expr *Expr) String() string {
 
 // Compile compiles an XPath expression string.
 func Compile(expr string) (*Expr, error) {
-	if expr == "" {
-		return nil, errors.New("expr expression is nil")
-	}
-	qy, err := build(expr, nil)
-	if err != nil {
-		return nil, err
-	}
-	if qy == nil {
-		return nil, fmt.Errorf(fmt.Sprintf("undeclared variable in XPath expression: %s", expr))
-	}
-	return &Expr{s: expr, q: qy}, nil
+	return compile(expr, nil)
 }
 
 // MustCompile compiles an XPath expression string and ignored error.
@@ -162,15 +416,117 @@ func MustCompile(expr string) *Expr {
 
 // CompileWithNS compiles an XPath expression string, using given namespaces map.
 func CompileWithNS(expr string, namespaces map[string]string) (*Expr, error) {
+	return compile(expr, &Options{Namespaces: namespaces})
+}
+
+// CompileWithVars compiles an XPath expression string that may reference
+// the given variables, such as "//item[@sku=$sku]". A prefixed variable
+// is declared with its prefix, e.g. "ns:name".
+func CompileWithVars(expr string, vars ...string) (*Expr, error) {
+	m := make(map[string]interface{}, len(vars))
+	for _, name := range vars {
+		m[name] = nil
+	}
+	return compile(expr, &Options{Variables: m})
+}
+
+// CompileWithOptions compiles an XPath expression string, using the
+// namespaces, variables, functions and options of opts.
+func CompileWithOptions(expr string, opts *Options) (*Expr, error) {
+	return compile(expr, opts)
+}
+
+func compile(expr string, opts *Options) (*Expr, error) {
 	if expr == "" {
 		return nil, errors.New("expr expression is nil")
 	}
-	qy, err := build(expr, namespaces)
+	qy, vars, err := build(expr, opts)
 	if err != nil {
 		return nil, err
 	}
 	if qy == nil {
 		return nil, fmt.Errorf(fmt.Sprintf("undeclared variable in XPath expression: %s", expr))
 	}
-	return &Expr{s: expr, q: qy}, nil
+	return &Expr{s: expr, q: qy, strict: opts != nil && opts.Strict, vars: vars}, nil
+}
+
+// VariableError is the error of an evaluation that has no value for a
+// variable referenced by the expression.
+type VariableError struct {
+	// Name is the name of the variable, with its prefix if it has one.
+	Name string
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("xpath: variable $%s has no value", e.Name)
+}
+
+// unbound returns a *VariableError if a variable referenced by the
+// expression has no value in vars.
+func (expr *Expr) unbound(vars map[string]interface{}) error {
+	for _, name := range expr.vars {
+		if v, ok := vars[name]; !ok || v == nil {
+			return &VariableError{Name: name}
+		}
+	}
+	return nil
+}
+
+// bindVariables converts the variable values into the form used by queries.
+// A node-set is read once, so it can be referenced more than once.
+func bindVariables(vars map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(vars))
+	for name, v := range vars {
+		switch v := v.(type) {
+		case string, float64, bool:
+			m[name] = v
+		case Sequence:
+			seq := make(Sequence, len(v))
+			nodes := make([]NodeNavigator, 0, len(v))
+			for i, item := range v {
+				if item.Node != nil {
+					item.Node = item.Node.Copy()
+					nodes = append(nodes, item.Node)
+				}
+				seq[i] = item
+			}
+			if len(nodes) == len(v) {
+				m[name] = nodes
+			} else {
+				m[name] = seq
+			}
+		case *NodeIterator:
+			var list []NodeNavigator
+			for v.MoveNext() {
+				list = append(list, v.Current().Copy())
+			}
+			m[name] = list
+		case []NodeNavigator:
+			list := make([]NodeNavigator, len(v))
+			for i, n := range v {
+				list[i] = n.Copy()
+			}
+			m[name] = list
+		case []string:
+			seq := make(Sequence, len(v))
+			for i, s := range v {
+				seq[i] = Item{Value: s}
+			}
+			m[name] = seq
+		default:
+			// Any Go number is an XPath number.
+			rv := reflect.ValueOf(v)
+			switch rv.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				m[name] = float64(rv.Int())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+				m[name] = float64(rv.Uint())
+			case reflect.Float32, reflect.Float64:
+				m[name] = rv.Float()
+			default:
+				panic(fmt.Errorf("xpath: unsupported type %T for variable $%s", v, name))
+			}
+		}
+	}
+	return m
 }
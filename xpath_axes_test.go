@@ -59,8 +59,8 @@ func Test_ancestor_predicate(t *testing.T) {
 		),
 	)
 
-	test_xpath_elements(t, doc, `//span/ancestor::*`, 7, 6, 5, 4, 2, 1, 12, 11, 10, 9)
-	test_xpath_elements(t, doc, `//span/ancestor::section`, 6, 4, 11, 9)
+	test_xpath_elements(t, doc, `//span/ancestor::*`, 1, 2, 4, 5, 6, 7, 9, 10, 11, 12)
+	test_xpath_elements(t, doc, `//span/ancestor::section`, 4, 6, 9, 11)
 	test_xpath_elements(t, doc, `//span/ancestor::section[1]`, 6, 11)
 	test_xpath_elements(t, doc, `//span/ancestor::section[2]`, 4, 9)
 }
@@ -88,8 +88,7 @@ func Test_ancestor_predicate_chain(t *testing.T) {
 }
 
 func Test_ancestor_or_self(t *testing.T) {
-	// Expected the value is [2, 3, 8, 13], but got [3, 2, 8, 13]
-	test_xpath_elements(t, employee_example, `//employee/ancestor-or-self::*`, 3, 2, 8, 13)
+	test_xpath_elements(t, employee_example, `//employee/ancestor-or-self::*`, 2, 3, 8, 13)
 	test_xpath_elements(t, employee_example, `//name/ancestor-or-self::employee`, 3, 8, 13)
 }
 
@@ -121,11 +120,11 @@ func Test_following_sibling(t *testing.T) {
 func Test_preceding(t *testing.T) {
 	//testXPath3(t, html, "//li[last()]/preceding-sibling::*[2]", selectNode(html, "//li[position()=2]"))
 	//testXPath3(t, html, "//li/preceding::*[1]", selectNode(html, "//h1"))
-	test_xpath_elements(t, employee_example, `//employee[@id=3]/preceding::*`, 8, 9, 10, 11, 3, 4, 5, 6)
+	test_xpath_elements(t, employee_example, `//employee[@id=3]/preceding::*`, 3, 4, 5, 6, 8, 9, 10, 11)
 }
 
 func Test_preceding_sibling(t *testing.T) {
-	test_xpath_elements(t, employee_example, `//employee[@id=3]/preceding-sibling::*`, 8, 3)
+	test_xpath_elements(t, employee_example, `//employee[@id=3]/preceding-sibling::*`, 3, 8)
 }
 
 func Test_namespace(t *testing.T) {
@@ -1,6 +1,7 @@
 package xpath
 
 import (
+	"math"
 	"testing"
 )
 
@@ -77,6 +78,99 @@ func TestExpressions(t *testing.T) {
 	// table/tbody/tr/td/(para, .[not(para)], ..)
 }
 
+// compareNavigator is a TNodeNavigator that compares the positions of its
+// nodes itself, counting the comparisons.
+type compareNavigator struct {
+	*TNodeNavigator
+	calls *int
+}
+
+func (n *compareNavigator) Copy() NodeNavigator {
+	return &compareNavigator{n.TNodeNavigator.Copy().(*TNodeNavigator), n.calls}
+}
+
+func (n *compareNavigator) MoveTo(other NodeNavigator) bool {
+	if o, ok := other.(*compareNavigator); ok {
+		other = o.TNodeNavigator
+	}
+	return n.TNodeNavigator.MoveTo(other)
+}
+
+func (n *compareNavigator) Compare(other NodeNavigator) int {
+	*n.calls++
+	return comparePaths(nodeOrderPath(n.TNodeNavigator), nodeOrderPath(other.(*compareNavigator).TNodeNavigator))
+}
+
+func TestDocumentOrder(t *testing.T) {
+	test_xpath_elements(t, book_example, `//book[@category = "children"] | //book[@category = "cooking"]`, 3, 9)
+	test_xpath_elements(t, book_example, `//book[2]/title | //book[1] | //book[2]/title`, 3, 10)
+	test_xpath_elements(t, book_example, `(//book[2]/title | //book[1])[1]`, 3)
+	test_xpath_count(t, book_example, `//title/@lang | //book[1]/title`, 5)
+	test_xpath_eval(t, book_example, `name((//title/@lang | //book[1]/title)[1])`, "title")
+	test_xpath_eval(t, book_example, `name((//title/@lang | //book[1]/title)[2])`, "lang")
+	test_xpath_elements(t, employee_example, `//name/../..`, 2)
+
+	/*
+	   <div>
+	     <div>
+	       <p/>
+	     </div>
+	     <p/>
+	   </div>
+	*/
+	doc := createNode("", RootNode)
+	div := doc.createChildNode("div", ElementNode)
+	div.lines = 1
+	inner := div.createChildNode("div", ElementNode)
+	inner.lines = 2
+	inner.createChildNode("p", ElementNode).lines = 3
+	div.createChildNode("p", ElementNode).lines = 4
+	test_xpath_elements(t, doc, `//div/p`, 3, 4)
+	test_xpath_elements(t, doc, `//p/ancestor::div`, 1, 2)
+	test_xpath_elements(t, doc, `(//div/p)[1]`, 3)
+	test_xpath_elements(t, doc, `//div/p[count(*) = 0]`, 3, 4)
+	test_xpath_elements(t, doc, `//p/..`, 1, 2)
+	test_xpath_elements(t, doc, `//div/p/..`, 1, 2)
+	test_xpath_elements(t, doc, `/div/div/..`, 1)
+	test_xpath_eval(t, doc, `count(//div/*/..)`, float64(2))
+
+	// A node-set passed to a function is in document order, while a
+	// step predicate counts in the order of its axis.
+	test_xpath_eval(t, book_example, `name(//title/ancestor::*)`, "bookstore")
+	test_xpath_eval(t, book_example, `name((//title/ancestor::*)[1])`, "bookstore")
+	test_xpath_eval(t, book_example, `name(//title/ancestor::*[1])`, "book")
+	test_xpath_eval(t, doc, `count(//div//p)`, float64(2))
+
+	// Sorting many siblings counts each of them once.
+	doc = createNode("", RootNode)
+	list := doc.createChildNode("list", ElementNode)
+	var lines []int
+	for i := 1; i <= 1000; i++ {
+		list.createChildNode("item", ElementNode).lines = i
+		if i < 1000 {
+			lines = append(lines, i)
+		}
+	}
+	test_xpath_elements(t, doc, `//item[last()]/preceding-sibling::item`, lines...)
+	nav := &nsNavigator{createNavigator(doc), -1}
+	iter := MustCompile(`//item[last()]/preceding-sibling::item`).Select(nav)
+	var got []int
+	for iter.MoveNext() {
+		got = append(got, iter.Current().(*nsNavigator).curr.lines)
+	}
+	assertEqual(t, lines, got)
+
+	var calls int
+	cmp := &compareNavigator{createNavigator(book_example), &calls}
+	iter = MustCompile(`//book[2] | //book[1]`).Select(cmp)
+	lines = nil
+	for iter.MoveNext() {
+		lines = append(lines, iter.Current().(*compareNavigator).curr.lines)
+	}
+	assertEqual(t, []int{3, 9}, lines)
+	assertTrue(t, calls > 0)
+}
+
 func TestSequence(t *testing.T) {
 	// `//table/tbody/tr/td/(para, .[not(para)],..)`
 	test_xpath_count(t, html_example, `//body/(h1, h2, p)`, 2)
@@ -164,3 +258,405 @@ func TestNonEnglishPredicateExpression(t *testing.T) {
 	n.createChildNode("Hello,World!", TextNode)
 	test_xpath_count(t, doc, "//h1[@id='断点']", 1)
 }
+
+func TestSequenceExpression(t *testing.T) {
+	test_xpath_sequence(t, book_example, `()`)
+	test_xpath_sequence(t, book_example, `(1, 'a', //book[1]/title)`, float64(1), "a", "Everyday Italian")
+	test_xpath_sequence(t, book_example, `1, 2`, float64(1), float64(2))
+	test_xpath_sequence(t, book_example, `((1, 2), (), 3)`, float64(1), float64(2), float64(3))
+	test_xpath_sequence(t, book_example, `count(//book)`, float64(4))
+	// A sequence of nodes is a node-set in the order of its items.
+	test_xpath_elements(t, book_example, `(//book[2], //book[1])`, 9, 3)
+	test_xpath_elements(t, book_example, `(//book[2], //book[1])/title`, 4, 10)
+	test_xpath_elements(t, book_example, `(//book[4], //title/ancestor::*)`, 25, 2, 3, 9, 15)
+	test_xpath_eval(t, book_example, `count((//book, //book))`, float64(8))
+
+	test_xpath_eval(t, book_example, `count((1, //book, 'a'))`, float64(6))
+	test_xpath_eval(t, book_example, `sum((1, 2, //book[1]/price))`, float64(33))
+	test_xpath_eval(t, book_example, `string((1, 2))`, "1")
+	test_xpath_eval(t, book_example, `string-join((1, 'a', //book[1]/year), '-')`, "1-a-2005")
+	test_xpath_eval(t, book_example, `boolean(())`, false)
+	test_xpath_eval(t, book_example, `boolean((//book, 0))`, true)
+	assertPanic(t, func() { MustCompile(`boolean((1, 2))`).Evaluate(createNavigator(book_example)) })
+
+	// General comparisons are true if they hold for a pair of items.
+	test_xpath_eval(t, book_example, `(1, 2) = 2`, true)
+	test_xpath_eval(t, book_example, `(1, 2) = (3, 4)`, false)
+	test_xpath_eval(t, book_example, `(1, 2) != (1, 2)`, true)
+	test_xpath_eval(t, book_example, `('a', 30) < //book/price`, true)
+	test_xpath_eval(t, book_example, `() = ()`, false)
+
+	v := MustCompile(`(1, 'a')`).Evaluate(createNavigator(book_example))
+	seq, ok := v.(Sequence)
+	assertTrue(t, ok)
+	assertEqual(t, 2, len(seq))
+	assertEqual(t, "1", seq[0].String())
+	assertEqual(t, false, seq[0].IsNode())
+
+	expr, err := CompileWithVars(`count($s) + sum($s)`, "s")
+	assertNoErr(t, err)
+	v = expr.EvaluateWithVars(createNavigator(book_example), map[string]interface{}{"s": Sequence{{Value: 1.5}, {Value: "2"}}})
+	assertEqual(t, 5.5, v)
+}
+
+func TestIfExpression(t *testing.T) {
+	test_xpath_eval(t, book_example, `if (count(//book) > 3) then 'many' else 'few'`, "many")
+	test_xpath_eval(t, book_example, `if (//book[@category='science']) then 1 else 2 + 3`, float64(5))
+	test_xpath_eval(t, book_example, `concat('a', if (()) then 'b' else 'c')`, "ac")
+	test_xpath_eval(t, book_example, `if (1) then if (0) then 1 else 2 else 3`, float64(2))
+	test_xpath_elements(t, book_example, `if (//book[1]/price > 100) then //book[1] else //book[2]`, 9)
+	test_xpath_elements(t, book_example, `//book[if (@category = 'web') then price > 40 else false()]`, 15)
+	test_xpath_elements(t, book_example, `if (true()) then //title/ancestor::* else ()`, 2, 3, 9, 15, 25)
+	test_xpath_elements(t, book_example, `//if`)
+
+	_, err := Compile(`if (1) then 2`)
+	assertErr(t, err)
+	_, err = CompileWithOptions(`if (1) then 2 else 3`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestForExpression(t *testing.T) {
+	test_xpath_sequence(t, book_example, `for $b in //book return $b/price * 2`, 60.0, 59.98, 99.98, 79.9)
+	test_xpath_sequence(t, book_example, `for $i in (1, 2), $j in (10, 20) return $i + $j`, 11.0, 21.0, 12.0, 22.0)
+	test_xpath_sequence(t, book_example, `for $b in //book[position() < 3], $a in $b/author return concat($a, ' (', $b/year, ')')`,
+		"Giada De Laurentiis (2005)", "J K. Rowling (2005)")
+	test_xpath_sequence(t, book_example, `for $x in () return 1`)
+	test_xpath_eval(t, book_example, `sum(for $b in //book return $b/price * 2)`, 299.86)
+	// The return expression keeps the context node.
+	test_xpath_elements(t, book_example, `//book[for $x in 35 return price > $x]`, 15, 25)
+	// A sequence of nodes is a node-set.
+	test_xpath_elements(t, book_example, `for $b in //book[@category='web'] return $b/title`, 16, 26)
+	test_xpath_elements(t, book_example, `(for $b in //book return $b)[2]`, 9)
+	// The variable of the inner expression hides the outer one.
+	test_xpath_sequence(t, book_example, `for $x in 1 return (for $x in 2 return $x, $x)`, 2.0, 1.0)
+
+	expr, err := CompileWithVars(`for $b in //book[@category=$cat] return $b/year`, "cat")
+	assertNoErr(t, err)
+	v := expr.EvaluateWithVars(createNavigator(book_example), map[string]interface{}{"cat": "children"})
+	assertEqual(t, "2005", iterateNavs(v.(*NodeIterator))[0].Value())
+
+	for _, s := range []string{`(for $x in 1 return $x), $x`, `for $x in 1 return $y`, `for $x in 1`} {
+		_, err = Compile(s)
+		assertErr(t, err)
+	}
+	_, err = CompileWithOptions(`for $x in 1 return $x`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestQuantifiedExpression(t *testing.T) {
+	test_xpath_eval(t, book_example, `some $b in //book satisfies $b/price > 40`, true)
+	test_xpath_eval(t, book_example, `every $b in //book satisfies $b/price > 40`, false)
+	test_xpath_eval(t, book_example, `every $b in //book satisfies $b/price > 0`, true)
+	test_xpath_eval(t, book_example, `some $x in () satisfies true()`, false)
+	test_xpath_eval(t, book_example, `every $x in () satisfies false()`, true)
+	test_xpath_eval(t, book_example, `some $x in (1, 2), $y in (2, 3) satisfies $x = $y`, true)
+	test_xpath_eval(t, book_example, `every $x in (1, 2), $y in (2, 3) satisfies $x < $y`, false)
+	test_xpath_eval(t, book_example, `every $b in //book satisfies some $a in $b/author satisfies $a != ''`, true)
+	test_xpath_elements(t, book_example, `//book[every $a in author satisfies contains($a, 'a')]`, 3, 25)
+	test_xpath_elements(t, book_example, `//book[some $p in (30, 40) satisfies price < $p]`, 3, 9, 25)
+
+	_, err := Compile(`some $x in (1, 2) return $x`)
+	assertErr(t, err)
+	_, err = CompileWithOptions(`every $x in 1 satisfies $x`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestLetExpression(t *testing.T) {
+	test_xpath_eval(t, book_example, `let $total := sum(//book/price) return $total * 2`, 299.86)
+	test_xpath_eval(t, book_example, `let $a := 2, $b := $a * 3 return $b - $a`, float64(4))
+	test_xpath_eval(t, book_example, `let $x := 1 return let $x := $x + 1 return $x`, float64(2))
+	test_xpath_elements(t, book_example, `let $b := //book[@category='web'] return $b/title`, 16, 26)
+	test_xpath_elements(t, book_example, `let $b := //book return $b[2]`, 9)
+	test_xpath_elements(t, book_example, `//book[let $p := price return $p > 35 and $p < 45]`, 25)
+	test_xpath_sequence(t, book_example, `let $s := (1, 'a') return ($s, $s)`, 1.0, "a", 1.0, "a")
+	test_xpath_sequence(t, book_example, `for $b in //book[position() < 3] return let $y := $b/year return string($y)`, "2005", "2005")
+
+	// The value is evaluated once, not once per reference.
+	var calls int
+	ctx := &Options{
+		Namespaces: map[string]string{"ext": "urn:ext"},
+		Functions: FunctionResolverFunc(func(_, name string) *Function {
+			return &Function{Returns: NumberType, Call: func(NodeNavigator, []interface{}) (interface{}, error) {
+				calls++
+				return float64(calls), nil
+			}}
+		}),
+	}
+	expr, err := CompileWithOptions(`let $x := ext:next() return $x + $x + $x`, ctx)
+	assertNoErr(t, err)
+	assertEqual(t, float64(3), expr.Evaluate(createNavigator(book_example)))
+	assertEqual(t, 1, calls)
+
+	for _, s := range []string{`let $x = 1 return $x`, `let $x := 1`, `(let $x := 1 return $x) + $x`} {
+		_, err = Compile(s)
+		assertErr(t, err)
+	}
+	_, err = CompileWithOptions(`let $x := 1 return $x`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestIntersectExcept(t *testing.T) {
+	test_xpath_elements(t, book_example, `//book except //book[@category='web']`, 3, 9)
+	test_xpath_elements(t, book_example, `//book intersect //book[price > 35]`, 15, 25)
+	test_xpath_elements(t, book_example, `//book[price > 35] intersect //book[@category='web']/self::book`, 15, 25)
+	test_xpath_elements(t, book_example, `//title/ancestor::* except /bookstore`, 3, 9, 15, 25)
+	test_xpath_elements(t, book_example, `(//book[4], //book[1]) except ()`, 3, 25)
+	// intersect and except bind tighter than the union.
+	test_xpath_elements(t, book_example, `//book[1] | //book[2] intersect //book[1]`, 3)
+	test_xpath_elements(t, book_example, `(//book[1] | //book[2]) intersect //book[1]`, 3)
+	test_xpath_count(t, book_example, `//book intersect //title`, 0)
+	test_xpath_count(t, book_example, `//except`, 0)
+	test_xpath_eval(t, book_example, `count(//book/* except //book/author)`, float64(12))
+
+	_, err := CompileWithOptions(`//book except //book[1]`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestRangeExpression(t *testing.T) {
+	test_xpath_sequence(t, book_example, `1 to 4`, 1.0, 2.0, 3.0, 4.0)
+	test_xpath_sequence(t, book_example, `-1 to 1`, -1.0, 0.0, 1.0)
+	test_xpath_sequence(t, book_example, `3 to 3`, 3.0)
+	test_xpath_sequence(t, book_example, `3 to 2`)
+	test_xpath_sequence(t, book_example, `() to 2`)
+	test_xpath_sequence(t, book_example, `1 + 1 to 2 * 2`, 2.0, 3.0, 4.0)
+	test_xpath_sequence(t, book_example, `for $i in 1 to 3 return $i * $i`, 1.0, 4.0, 9.0)
+	test_xpath_eval(t, book_example, `sum(1 to 100)`, float64(5050))
+	test_xpath_eval(t, book_example, `count(1 to count(//book))`, float64(4))
+	test_xpath_elements(t, book_example, `//book[position() = 2 to 3]`, 9, 15)
+
+	expr, err := CompileWithVars(`$start to $end`, "start", "end")
+	assertNoErr(t, err)
+	seq, err := expr.EvaluateSequence(createNavigator(book_example))
+	assertErr(t, err)
+	v := expr.EvaluateWithVars(createNavigator(book_example), map[string]interface{}{"start": 2.0, "end": "4"})
+	assertEqual(t, 3, len(v.(Sequence)))
+
+	for _, s := range []string{`1.5 to 3`, `(1, 2) to 3`, `'a' to 3`, `1 to 100000000000000000000`, `sum(1 to 10000000000)`} {
+		seq, err = MustCompile(s).EvaluateSequence(createNavigator(book_example))
+		assertErr(t, err)
+		assertEqual(t, 0, len(seq))
+	}
+
+	// A range that is iterated is not built.
+	test_xpath_eval(t, empty_example, `count(1 to 10000000000)`, float64(1e10))
+	test_xpath_eval(t, empty_example, `count(5 to 1)`, float64(0))
+	test_xpath_eval(t, empty_example, `some $i in 1 to 10000000000 satisfies $i = 3`, true)
+	test_xpath_eval(t, empty_example, `every $i in 1 to 10000000000 satisfies $i < 3`, false)
+	// A position picks an integer, and a comparison uses the bounds.
+	test_xpath_sequence(t, empty_example, `(1 to 10000000)[1]`, 1.0)
+	test_xpath_sequence(t, empty_example, `(3 to 10000000)[5]`, 7.0)
+	test_xpath_sequence(t, empty_example, `(1 to 2)[3]`)
+	test_xpath_sequence(t, empty_example, `(1 to 2)[1.5]`)
+	test_xpath_elements(t, book_example, `//book[position() = 2 to 10000000]`, 9, 15, 25)
+	test_xpath_elements(t, book_example, `//book[2 to 3 = position()]`, 9, 15)
+	test_xpath_elements(t, book_example, `//book[position() != 2 to 2]`, 3, 15, 25)
+	test_xpath_elements(t, book_example, `//book[position() < 1 to 2]`, 3)
+	test_xpath_elements(t, book_example, `//book[3 to 4 <= position()]`, 15, 25)
+	test_xpath_eval(t, empty_example, `'2' = (1 to 3)`, true)
+	test_xpath_eval(t, empty_example, `2.5 = (1 to 3)`, false)
+	test_xpath_eval(t, empty_example, `(5, 2) = (1 to 3)`, true)
+	test_xpath_eval(t, empty_example, `1 = (3 to 1)`, false)
+	test_xpath_eval(t, empty_example, `true() = (0 to 0)`, false)
+	test_xpath_eval(t, empty_example, `false() = (0 to 1)`, true)
+
+	// The built sequences are bounded by MaxSequenceLength.
+	for _, s := range []string{`sum(1 to 1001)`, `for $i in 1 to 1000000000 return $i`, `(1 to 1000000000) ! .`, `(1 to 600, 1 to 600)`} {
+		_, err = MustCompile(s).EvaluateWithOptions(createNavigator(book_example), &Options{Limits: Limits{MaxSequenceLength: 1000}})
+		if e, ok := err.(*LimitError); !ok || e.Limit != "MaxSequenceLength" {
+			t.Fatalf("%s: expected a MaxSequenceLength LimitError, got %v", s, err)
+		}
+	}
+	v, err = MustCompile(`count(1 to 1000)`).EvaluateWithOptions(createNavigator(book_example), &Options{Limits: Limits{MaxSequenceLength: 1}})
+	assertNoErr(t, err)
+	assertEqual(t, float64(1000), v)
+	_, err = CompileWithOptions(`1 to 3`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestValueComparison(t *testing.T) {
+	test_xpath_eval(t, empty_example, `1 eq 1`, true)
+	test_xpath_eval(t, empty_example, `1 ne 1`, false)
+	test_xpath_eval(t, empty_example, `1 lt 2`, true)
+	test_xpath_eval(t, empty_example, `2 le 1`, false)
+	test_xpath_eval(t, empty_example, `'b' gt 'a'`, true)
+	test_xpath_eval(t, empty_example, `'10' lt '9'`, true)
+	test_xpath_eval(t, empty_example, `true() ge false()`, true)
+	test_xpath_eval(t, empty_example, `1 + 1 eq 2 and 2 lt 3`, true)
+	test_xpath_eval(t, empty_example, `number('a') eq number('a')`, false)
+	test_xpath_eval(t, empty_example, `number('a') ne number('a')`, true)
+
+	// Nodes are compared by their string values.
+	test_xpath_eval(t, book_example, `//book[1]/price gt 29.99`, true)
+	test_xpath_eval(t, book_example, `//book[1]/@category eq 'cooking'`, true)
+	test_xpath_eval(t, book_example, `//book[3]/@category eq //book[4]/@category`, true)
+	test_xpath_elements(t, book_example, `//book[price lt 35]`, 3, 9)
+	test_xpath_elements(t, book_example, `//book[@category ne 'web']`, 3, 9)
+
+	// An empty operand gives the empty sequence, which is false.
+	test_xpath_sequence(t, book_example, `//book[1]/@lang eq 'en'`)
+	test_xpath_sequence(t, book_example, `() eq 1`)
+	test_xpath_elements(t, book_example, `//book[@lang eq 'en']`)
+	test_xpath_eval(t, book_example, `not(//book[1]/@lang eq 'en')`, true)
+
+	for _, s := range []string{
+		`//book/price eq 30`, // more than one item
+		`(1, 2) eq 1`,
+		`1 eq '1'`,
+		`true() eq 1`,
+		`//book[1]/price eq true()`,
+	} {
+		_, err := MustCompile(s).EvaluateSequence(createNavigator(book_example))
+		assertErr(t, err)
+	}
+	// The general comparison is true for any pair of nodes.
+	test_xpath_eval(t, book_example, `//book/price = 30`, true)
+
+	for _, s := range []string{`1 eq 1`, `1 ne 1`, `1 lt 1`, `1 le 1`, `1 gt 1`, `1 ge 1`} {
+		_, err := CompileWithOptions(s, &Options{Strict: true})
+		assertErr(t, err)
+	}
+	test_xpath_elements(t, employee_example, `//eq`)
+}
+
+func TestNodeComparison(t *testing.T) {
+	test_xpath_eval(t, book_example, `//book[1] is //book[1]`, true)
+	test_xpath_eval(t, book_example, `//book[1] is //book[2]`, false)
+	test_xpath_eval(t, book_example, `//book[1]/title is (//title)[1]`, true)
+	test_xpath_eval(t, book_example, `//book[1] << //book[2]`, true)
+	test_xpath_eval(t, book_example, `//book[1] >> //book[2]`, false)
+	test_xpath_eval(t, book_example, `//book[1] << //book[1]`, false)
+	test_xpath_eval(t, book_example, `//book[1] << //book[1]/title`, true)
+	test_xpath_eval(t, book_example, `//book[1]/@category << //book[1]/title`, true)
+	test_xpath_eval(t, book_example, `//book[4]/title >> //book[1]/price`, true)
+	test_xpath_elements(t, book_example, `//book[. << //book[3]]`, 3, 9)
+	test_xpath_elements(t, book_example, `//book[. >> //book[3]]`, 25)
+	test_xpath_elements(t, book_example, `//title[. is //book[2]/title]`, 10)
+	test_xpath_elements(t, book_example, `//book[not(. is //book[2])]`, 3, 15, 25)
+
+	expr, err := CompileWithVars(`$a is $b`, "a", "b")
+	assertNoErr(t, err)
+	doc := createNavigator(book_example)
+	book := selectNode(book_example, "//book[1]")
+	v := expr.EvaluateWithVars(doc, map[string]interface{}{
+		"a": []NodeNavigator{createNavigator(book)},
+		"b": []NodeNavigator{createNavigator(book)},
+	})
+	assertEqual(t, true, v)
+
+	// The nodes at the same position in two documents are different nodes,
+	// in a stable order.
+	other := createBookExample()
+	vars := map[string]interface{}{
+		"a": []NodeNavigator{createNavigator(book_example)},
+		"b": []NodeNavigator{createNavigator(other)},
+	}
+	assertEqual(t, false, expr.EvaluateWithVars(doc, vars))
+	expr, err = CompileWithVars(`($a << $b) != ($a >> $b)`, "a", "b")
+	assertNoErr(t, err)
+	assertEqual(t, true, expr.EvaluateWithVars(doc, vars))
+
+	// An empty operand gives the empty sequence, which is false.
+	test_xpath_sequence(t, book_example, `//book[5] is //book[1]`)
+	test_xpath_sequence(t, book_example, `//book[1] << ()`)
+	test_xpath_elements(t, book_example, `//book[. is //book[5]]`)
+
+	for _, s := range []string{`//book is //book[1]`, `1 is 1`, `//book[1] << 'a'`} {
+		_, err := MustCompile(s).EvaluateSequence(createNavigator(book_example))
+		assertErr(t, err)
+	}
+	for _, s := range []string{`. is .`, `. << .`, `. >> .`} {
+		_, err := CompileWithOptions(s, &Options{Strict: true})
+		assertErr(t, err)
+	}
+}
+
+func TestSimpleMapExpression(t *testing.T) {
+	test_xpath_sequence(t, book_example, `//book ! string(@category)`, "cooking", "children", "web", "web")
+	test_xpath_sequence(t, book_example, `//book ! count(author)`, 1.0, 1.0, 5.0, 1.0)
+	test_xpath_sequence(t, book_example, `//book[@category = 'web'] ! (title, price)`,
+		"XQuery Kick Start", "49.99", "Learning XML", "39.95")
+	test_xpath_sequence(t, book_example, `//book ! @category ! upper-case(.)`, "COOKING", "CHILDREN", "WEB", "WEB")
+	test_xpath_sequence(t, book_example, `//book[5] ! title`)
+	test_xpath_eval(t, book_example, `sum(//book ! (price * 2))`, 299.86)
+	// A map to nodes only is a node-set, in the order of the mapped values.
+	test_xpath_elements(t, book_example, `//book ! title`, 4, 10, 16, 26)
+	test_xpath_eval(t, book_example, `count(//title ! ..)`, float64(4))
+	test_xpath_eval(t, book_example, `count(//book ! /bookstore)`, float64(4))
+	// != is still the general comparison.
+	test_xpath_elements(t, book_example, `//book[@category!='web']`, 3, 9)
+
+	// The context item may be an atomic value.
+	test_xpath_sequence(t, empty_example, `(1 to 3) ! (. * 2)`, 2.0, 4.0, 6.0)
+	test_xpath_sequence(t, empty_example, `('a', 'b') ! concat(., '-', string-length(.))`, "a-1", "b-1")
+	test_xpath_sequence(t, empty_example, `(1, 2) ! string()`, "1", "2")
+	test_xpath_sequence(t, empty_example, `(1, 2) ! ((3, 4) ! .)`, 3.0, 4.0, 3.0, 4.0)
+	test_xpath_sequence(t, empty_example, `(1, 2) ! (for $x in (10, 20) return . + $x)`, 11.0, 21.0, 12.0, 22.0)
+	test_xpath_eval(t, empty_example, `sum((1 to 3) ! (. * 2))`, 12.0)
+	test_xpath_sequence(t, book_example, `//book[1] ! (1, 2) ! .`, 1.0, 2.0)
+	test_xpath_sequence(t, book_example, `(1, 2) ! count(//book[price > 35])`, 2.0, 2.0)
+	test_xpath_sequence(t, book_example, `//book[2] ! (1 to 2) ! //book[1]/@category ! string()`, "cooking", "cooking")
+	for _, s := range []string{`(1, 2) ! title`, `(1, 2) ! ./title`, `(1, 2) ! name()`, `'a' ! .[1]`} {
+		_, err := MustCompile(s).EvaluateSequence(createNavigator(book_example))
+		assertErr(t, err)
+	}
+	_, err := CompileWithOptions(`//book ! title`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func TestArrowExpression(t *testing.T) {
+	test_xpath_eval(t, empty_example, `'abc' => upper-case()`, "ABC")
+	test_xpath_eval(t, empty_example, `'  a  b ' => upper-case() => normalize-space()`, "A B")
+	test_xpath_eval(t, empty_example, `'a-b-c' => substring-after('-')`, "b-c")
+	test_xpath_eval(t, empty_example, `'a,b' => concat(',', 'c') => string-length()`, float64(5))
+	test_xpath_eval(t, book_example, `//book => count()`, float64(4))
+	test_xpath_eval(t, book_example, `//book/price => sum() => floor()`, float64(149))
+	test_xpath_sequence(t, book_example, `//book ! (@category => upper-case())`, "COOKING", "CHILDREN", "WEB", "WEB")
+	// The minus sign binds tighter than =>.
+	test_xpath_eval(t, empty_example, `-2 => concat('a')`, "-2a")
+	test_xpath_eval(t, empty_example, `--2 => concat('a')`, "2a")
+	test_xpath_eval(t, empty_example, `-2 => concat('a') => concat('b')`, "-2ab")
+	test_xpath_eval(t, empty_example, `-(2 => concat('1'))`, -21.0)
+	number := func(f func(float64) float64) *Function {
+		return &Function{MinArgs: 1, MaxArgs: 1, Args: []ValueType{NumberType}, Returns: NumberType,
+			Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+				return f(args[0].(float64)), nil
+			},
+		}
+	}
+	opts := &Options{
+		Namespaces: map[string]string{"m": "urn:test:math"},
+		Functions: FunctionResolverFunc(func(_, name string) *Function {
+			return map[string]*Function{
+				"abs": number(math.Abs),
+				"f":   number(func(x float64) float64 { return x + 1 }),
+				"g":   number(func(x float64) float64 { return x * 10 }),
+			}[name]
+		}),
+		Variables: map[string]interface{}{"x": 2},
+	}
+	for s, want := range map[string]float64{
+		`-1 => m:abs()`:             1,
+		`- $x => m:f() => m:g()`:    -10,
+		`-(1 => m:abs())`:           -1,
+		`- - $x => m:f() => m:g()`:  30,
+		`-($x => m:f()) => m:abs()`: 3,
+	} {
+		expr, err := CompileWithOptions(s, opts)
+		assertNoErr(t, err)
+		v, err := expr.EvaluateWithOptions(createNavigator(empty_example), opts)
+		assertNoErr(t, err)
+		assertEqual(t, want, v)
+	}
+
+	expr, err := CompileWithVars(`$s => upper-case() => normalize-space()`, "s")
+	assertNoErr(t, err)
+	v := expr.EvaluateWithVars(createNavigator(empty_example), map[string]interface{}{"s": " Hello   world "})
+	assertEqual(t, "HELLO WORLD", v)
+
+	for _, s := range []string{`'a' =>`, `'a' => upper-case`, `'a' => 'b'`, `'a' => upper-case('b')`} {
+		_, err := Compile(s)
+		assertErr(t, err)
+	}
+	_, err = CompileWithOptions(`'a' => string()`, &Options{Strict: true})
+	assertErr(t, err)
+}
@@ -1,7 +1,11 @@
 package xpath
 
 import (
+	"fmt"
 	"math"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -81,6 +85,328 @@ func Test_func_ends_with(t *testing.T) {
 	assertPanic(t, func() { selectNode(html_example, `//*[ends-with(name(), 0)]`) })
 }
 
+func Test_func_format_number(t *testing.T) {
+	test_xpath_eval(t, empty_example, `format-number(1234567.891, '#,##0.00')`, "1,234,567.89")
+	test_xpath_eval(t, empty_example, `format-number(0.5, '#.00')`, ".50")
+	test_xpath_eval(t, empty_example, `format-number(0, '#')`, "0")
+	test_xpath_eval(t, empty_example, `format-number(7, '000')`, "007")
+	test_xpath_eval(t, empty_example, `format-number(2.5, '0')`, "2")
+	test_xpath_eval(t, empty_example, `format-number(3.14159, '0.0##')`, "3.142")
+	test_xpath_eval(t, empty_example, `format-number(3.1, '0.0##')`, "3.1")
+	test_xpath_eval(t, empty_example, `format-number(0.256, '#0.0%')`, "25.6%")
+	test_xpath_eval(t, empty_example, `format-number(0.0126, '#0‰')`, "13‰")
+	test_xpath_eval(t, empty_example, `format-number(-12.5, '#,##0.00')`, "-12.50")
+	test_xpath_eval(t, empty_example, `format-number(-12.5, '#,##0.00;(#,##0.00)')`, "(12.50)")
+	test_xpath_eval(t, empty_example, `format-number(12345678, '#,##,##0')`, "123,45,678")
+	test_xpath_eval(t, empty_example, `format-number(0 div 0, '#')`, "NaN")
+	test_xpath_eval(t, empty_example, `format-number(-1 div 0, '#')`, "-Infinity")
+	test_xpath_eval(t, employee_example, `format-number(count(//employee), '$0.00')`, "$3.00")
+
+	for _, picture := range []string{"", "abc", "#.#.#", "#;#;#", "#%%", "#,", "0.#0"} {
+		_, err := Compile(fmt.Sprintf("format-number(1, '%s')", picture))
+		assertErr(t, err)
+	}
+	_, err := Compile("format-number(1, '#', 'eu')")
+	assertErr(t, err)
+
+	ctx := &Options{DecimalFormats: map[string]*DecimalFormat{
+		"eu": {DecimalSeparator: ',', GroupingSeparator: '.'},
+		"":   {NaN: "n/a"},
+	}}
+	expr, err := CompileWithOptions("format-number(1234.5, '#.##0,00', 'eu')", ctx)
+	assertNoErr(t, err)
+	assertEqual(t, "1.234,50", expr.Evaluate(createNavigator(empty_example)))
+	expr, err = CompileWithOptions("format-number(number('x'), '#')", ctx)
+	assertNoErr(t, err)
+	assertEqual(t, "n/a", expr.Evaluate(createNavigator(empty_example)))
+}
+
+type nodeIDNavigator struct {
+	*TNodeNavigator
+}
+
+func (n nodeIDNavigator) NodeID() string {
+	return fmt.Sprintf("%p", n.curr)
+}
+
+func Test_func_function_available(t *testing.T) {
+	test_xpath_eval(t, empty_example, `function-available('concat')`, true)
+	test_xpath_eval(t, empty_example, `function-available('lower-case')`, true)
+	test_xpath_eval(t, empty_example, `function-available('geo-distance')`, false)
+	test_xpath_eval(t, empty_example, `function-available('ext:geo-distance')`, false)
+	for name := range builtinFunctions {
+		test_xpath_eval(t, empty_example, "function-available('"+name+"')", true)
+	}
+
+	const ns = "urn:test:available"
+	assertNoErr(t, RegisterFunction(ns, "geo-distance", &Function{
+		Returns: NumberType,
+		MaxArgs: -1,
+		Call: func(_ NodeNavigator, _ []interface{}) (interface{}, error) {
+			return float64(0), nil
+		},
+	}))
+	defer UnregisterFunction(ns, "geo-distance")
+	ctx := &Options{Namespaces: map[string]string{"ext": ns}}
+	eval := func(expr string) interface{} {
+		e, err := CompileWithOptions(expr, ctx)
+		assertNoErr(t, err)
+		return e.Evaluate(createNavigator(empty_example))
+	}
+	assertEqual(t, true, eval(`function-available('ext:geo-distance')`))
+	assertEqual(t, false, eval(`function-available('ext:geo')`))
+	assertEqual(t, false, eval(`function-available('other:geo-distance')`))
+	assertEqual(t, true, eval(`function-available(concat('ext:', 'geo-distance'))`))
+
+	// function-available() is an XSLT function, so strict mode rejects it.
+	ctx.Strict = true
+	_, err := CompileWithOptions(`function-available('substring')`, ctx)
+	assertErr(t, err)
+}
+
+func Test_func_element_available(t *testing.T) {
+	test_xpath_eval(t, empty_example, `element-available('xsl:if')`, false)
+	assertPanic(t, func() { selectNode(empty_example, `element-available()`) })
+}
+
+func Test_func_system_property(t *testing.T) {
+	test_xpath_eval(t, empty_example, `system-property('xsl:vendor')`, "antchfx")
+	test_xpath_eval(t, empty_example, `system-property('xsl:vendor-url')`, "https://github.com/antchfx/xpath")
+	test_xpath_eval(t, empty_example, `system-property('xsl:version')`, float64(1))
+	test_xpath_eval(t, empty_example, `system-property('xsl:none')`, "")
+	test_xpath_eval(t, empty_example, `system-property('vendor')`, "")
+	// The version of this package is not recorded in its own tests.
+	test_xpath_eval(t, empty_example, `system-property('xsl:product-version')`, unknownVersion)
+
+	ctx := &Options{Namespaces: map[string]string{"t": "http://www.w3.org/1999/XSL/Transform", "xsl": "urn:other"}}
+	expr, err := CompileWithOptions(`system-property('t:version')`, ctx)
+	assertNoErr(t, err)
+	assertEqual(t, float64(1), expr.Evaluate(createNavigator(empty_example)))
+	expr, err = CompileWithOptions(`system-property('xsl:vendor')`, ctx)
+	assertNoErr(t, err)
+	assertEqual(t, "", expr.Evaluate(createNavigator(empty_example)))
+}
+
+func Test_func_generate_id(t *testing.T) {
+	test_xpath_eval(t, employee_example, `generate-id(//employee[1]) = generate-id(//employee[1]/name/..)`, true)
+	test_xpath_eval(t, employee_example, `generate-id(//employee[1]) = generate-id(//employee[2])`, false)
+	test_xpath_eval(t, employee_example, `generate-id(//none)`, "")
+	test_xpath_elements(t, employee_example, `//employee[generate-id() = generate-id(//employee[2])]`, 8)
+	assertPanic(t, func() { selectNode(employee_example, `generate-id(1, 2)`) })
+
+	seen := make(map[string]bool)
+	expr := MustCompile("generate-id()")
+	iter := MustCompile("//node() | //@*").Select(createNavigator(employee_example))
+	for iter.MoveNext() {
+		id := expr.Evaluate(iter.Current().Copy()).(string)
+		if seen[id] {
+			t.Fatalf("generate-id() returned %s for two nodes", id)
+		}
+		seen[id] = true
+	}
+
+	nav := nodeIDNavigator{createNavigator(employee_example)}
+	assertEqual(t, fmt.Sprintf("id%p", employee_example), expr.Evaluate(nav))
+
+	// The identifiers are names made of ASCII letters and digits, which
+	// differ between documents.
+	id := MustCompile(`generate-id(//employee[2]/@id)`).Evaluate(createNavigator(employee_example)).(string)
+	if !regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`).MatchString(id) {
+		t.Fatalf("generate-id() returned %q", id)
+	}
+	assertEqual(t, id, MustCompile(`generate-id(//employee[2]/@id)`).Evaluate(createNavigator(employee_example)))
+	// The nodes at the same position in two documents have different
+	// identifiers in one evaluation.
+	e, err := CompileWithVars(`generate-id($a) = generate-id($b)`, "a", "b")
+	assertNoErr(t, err)
+	v := e.EvaluateWithVars(createNavigator(employee_example), map[string]interface{}{
+		"a": []NodeNavigator{createNavigator(createNode("", RootNode))},
+		"b": []NodeNavigator{createNavigator(createNode("", RootNode))},
+	})
+	assertEqual(t, false, v)
+	doc := createNavigator(employee_example)
+	v = e.EvaluateWithVars(doc, map[string]interface{}{
+		"a": []NodeNavigator{doc},
+		"b": []NodeNavigator{createNavigator(employee_example)},
+	})
+	assertEqual(t, true, v)
+}
+
+// idNavigator is a TNodeNavigator that looks up the elements by ID in an
+// index rather than scanning the document.
+type idNavigator struct {
+	*TNodeNavigator
+	index map[string]*TNode
+}
+
+func (n *idNavigator) Copy() NodeNavigator {
+	return &idNavigator{n.TNodeNavigator.Copy().(*TNodeNavigator), n.index}
+}
+
+func (n *idNavigator) MoveTo(other NodeNavigator) bool {
+	if o, ok := other.(*idNavigator); ok {
+		other = o.TNodeNavigator
+	}
+	return n.TNodeNavigator.MoveTo(other)
+}
+
+func (n *idNavigator) MoveToID(id string) bool {
+	node, ok := n.index[id]
+	if ok {
+		n.curr, n.attr = node, -1
+	}
+	return ok
+}
+
+func Test_func_id(t *testing.T) {
+	doc := createNode("", RootNode)
+	list := doc.createChildNode("list", ElementNode)
+	a := list.createChildNode("a", ElementNode)
+	a.addAttribute("id", "x1")
+	b := a.createChildNode("b", ElementNode)
+	b.addAttribute("xml:id", "x2")
+	c := list.createChildNode("c", ElementNode)
+	c.addAttribute("id", "x3")
+	c.addAttribute("ref", "x2 x1")
+	d := list.createChildNode("d", ElementNode)
+	d.addAttribute("key", "x1")
+	// The navigator gives the attributes the prefix of their element, so
+	// this is a foo:id attribute, which is not an ID attribute.
+	e := list.createChildNode("e", ElementNode)
+	e.Prefix = "foo"
+	e.addAttribute("id", "x4")
+
+	test_xpath_tags(t, doc, `id('x3 x1 x2 x9')`, "a", "b", "c")
+	test_xpath_tags(t, doc, `id(//c/@ref)`, "a", "b")
+	test_xpath_tags(t, doc, `id('x2')/..`, "a")
+	test_xpath_count(t, doc, `id('')`, 0)
+	test_xpath_count(t, doc, `id('x4')`, 0)
+	test_xpath_eval(t, doc, `count(id('x1 x1'))`, float64(1))
+
+	expr, err := CompileWithOptions(`id('x1')`, &Options{IDAttributes: []string{"key"}})
+	assertNoErr(t, err)
+	assertEqual(t, []*TNode{d}, iterateNodes(expr.Select(createNavigator(doc))))
+
+	nav := &idNavigator{createNavigator(doc), map[string]*TNode{"k1": c, "k2": a}}
+	iter := MustCompile(`id('k1 k2 x1')`).Select(nav)
+	var nodes []*TNode
+	for iter.MoveNext() {
+		nodes = append(nodes, iter.Current().(*idNavigator).curr)
+	}
+	assertEqual(t, []*TNode{a, c}, nodes)
+}
+
+func Test_func_key(t *testing.T) {
+	doc := createNode("", RootNode)
+	shop := doc.createChildNode("shop", ElementNode)
+	for _, c := range [][2]string{{"c1", "Ann"}, {"c2", "Bob"}, {"c3", "Cid"}} {
+		customer := shop.createChildNode("customer", ElementNode)
+		customer.addAttribute("id", c[0])
+		customer.createChildNode("name", ElementNode).createChildNode(c[1], TextNode)
+	}
+	for _, o := range [][2]string{{"o1", "c2"}, {"o2", "c1"}, {"o3", "c2"}} {
+		order := shop.createChildNode("order", ElementNode)
+		order.addAttribute("id", o[0])
+		order.addAttribute("cust", o[1])
+	}
+
+	ctx := &Options{Keys: map[string]Key{
+		"customer": {Match: "customer", Use: "@id"},
+		"orders":   {Match: "shop/order", Use: "@cust"},
+	}}
+	eval := func(expr string) interface{} {
+		e, err := CompileWithOptions(expr, ctx)
+		assertNoErr(t, err)
+		return e.Evaluate(createNavigator(doc))
+	}
+	names := func(expr string) []string {
+		var list []string
+		for iter := eval(expr).(*NodeIterator); iter.MoveNext(); {
+			list = append(list, iter.Current().Value())
+		}
+		return list
+	}
+	assertEqual(t, []string{"Bob"}, names(`key('customer', 'c2')/name`))
+	assertEqual(t, []string{"Ann", "Bob"}, names(`key('customer', //order/@cust)/name`))
+	assertEqual(t, []string{"o1", "o3"}, names(`//order[key('customer', @cust)/name = 'Bob']/@id`))
+	assertEqual(t, float64(2), eval(`count(key('orders', 'c2'))`))
+	assertEqual(t, float64(0), eval(`count(key('orders', 'c3'))`))
+	assertEqual(t, float64(2), eval(`count(//customer[key('orders', @id)])`))
+	assertEqual(t, float64(1), eval(`count(key(concat('cust', 'omer'), 'c1'))`))
+
+	// An evaluation builds the index of each document it looks up, and
+	// evaluations of the same expression run concurrently.
+	expr, err := CompileWithOptions(`count(key('customer', 'c1'))`, ctx)
+	assertNoErr(t, err)
+	assertEqual(t, float64(1), expr.Evaluate(createNavigator(doc)))
+	assertEqual(t, float64(0), expr.Evaluate(createNavigator(empty_example)))
+	assertEqual(t, float64(1), expr.Evaluate(createNavigator(doc)))
+	var wg sync.WaitGroup
+	results := make([]interface{}, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			root := doc
+			if i%2 == 1 {
+				root = empty_example
+			}
+			results[i] = expr.Evaluate(createNavigator(root))
+		}(i)
+	}
+	wg.Wait()
+	for i, v := range results {
+		assertEqual(t, float64(1-i%2), v)
+	}
+	assertEqual(t, []string{"Ann", "Bob"}, names(`key('customer', 'c1')/name | key('customer', 'c2')/name`))
+
+	// A KeyCache keeps the indexes across evaluations, and expressions,
+	// until it is cleared: a changed ID is only seen after that.
+	cache := &KeyCache{}
+	opts := &Options{Keys: ctx.Keys, KeyCache: cache}
+	count := func(expr string) interface{} {
+		e, err := CompileWithOptions(expr, opts)
+		assertNoErr(t, err)
+		v, err := e.EvaluateWithOptions(createNavigator(doc), opts)
+		assertNoErr(t, err)
+		return v
+	}
+	assertEqual(t, float64(1), count(`count(key('customer', 'c1'))`))
+	customer := shop.FirstChild
+	customer.Attr[0].Value = "c9"
+	assertEqual(t, float64(1), count(`count(key('customer', 'c1'))`))
+	assertEqual(t, float64(0), count(`count(key('customer', 'c9'))`))
+	assertEqual(t, float64(0), eval(`count(key('customer', 'c1'))`))
+	cache.Clear()
+	assertEqual(t, float64(0), count(`count(key('customer', 'c1'))`))
+	assertEqual(t, float64(1), count(`count(key('customer', 'c9'))`))
+	customer.Attr[0].Value = "c1"
+
+	_, err = CompileWithOptions(`key('none', 'c1')`, ctx)
+	assertErr(t, err)
+	_, err = CompileWithOptions(`key('bad', 'c1')`, &Options{Keys: map[string]Key{"bad": {Match: "count(a)", Use: "."}}})
+	assertErr(t, err)
+	assertPanic(t, func() { eval(`count(key(concat('no', 'ne'), 'c1'))`) })
+}
+
+func Test_func_lang(t *testing.T) {
+	doc := createNode("", RootNode)
+	catalog := doc.createChildNode("catalog", ElementNode)
+	catalog.addAttribute("xml:lang", "en-US")
+	catalog.createChildNode("item", ElementNode)
+	item := catalog.createChildNode("item", ElementNode)
+	item.addAttribute("xml:lang", "FR")
+	item.createChildNode("para", ElementNode)
+
+	test_xpath_count(t, doc, `//item[lang('en')]`, 1)
+	test_xpath_count(t, doc, `//item[lang('en-us')]`, 1)
+	test_xpath_count(t, doc, `//item[lang('e')]`, 0)
+	test_xpath_count(t, doc, `//para[lang('fr')]`, 1)
+	test_xpath_count(t, doc, `//*[lang('en-GB')]`, 0)
+	test_xpath_eval(t, doc, `lang('en')`, false)
+	assertPanic(t, func() { selectNode(doc, `//item[lang()]`) })
+}
+
 func Test_func_last(t *testing.T) {
 	test_xpath_elements(t, book_example, `//bookstore[last()]`, 2)
 	test_xpath_elements(t, book_example, `//bookstore/book[last()]`, 25)
@@ -152,6 +478,9 @@ func Test_func_string_length(t *testing.T) {
 	test_xpath_eval(t, html_example, `string-length(//title/text())`, float64(len("My page")))
 	test_xpath_eval(t, html_example, `string-length(//html/@lang)`, float64(len("en")))
 	test_xpath_count(t, employee_example, `//employee[string-length(@id) > 0]`, 3) // = //employee[@id]
+	// Other values are converted as by string().
+	test_xpath_eval(t, empty_example, `string-length(12.5)`, float64(4))
+	test_xpath_eval(t, empty_example, `string-length(true())`, float64(4))
 }
 
 func Test_func_substring(t *testing.T) {
@@ -299,6 +628,7 @@ func Test_func_normalize_space(t *testing.T) {
 	const expectedStr = `loooooooonnnnnnngggggggg tes t strin g`
 	test_xpath_eval(t, empty_example, `normalize-space("`+testStr+`")`, expectedStr)
 	test_xpath_eval(t, empty_example, `normalize-space(' abc ')`, "abc")
+	test_xpath_eval(t, empty_example, `normalize-space(12)`, "12")
 	n := selectNode(employee_example, `//employee[@id="1"]/name`)
 	test_xpath_eval(t, n, `normalize-space()`, "Opal Kole")
 	test_xpath_eval(t, n, `normalize-space(.)`, "Opal Kole")
@@ -314,6 +644,85 @@ func Test_func_lower_case(t *testing.T) {
 	//test_xpath_eval(t, employee_example, `//employee/name/lower-case(text())`, "opal kole", "max miller", "beccaa moss")
 }
 
+func Test_func_upper_case(t *testing.T) {
+	test_xpath_eval(t, empty_example, `upper-case("ABc!d")`, "ABC!D")
+	test_xpath_elements(t, employee_example, `//name[upper-case(@from) = "CA"]`, 9)
+	_, err := CompileWithOptions(`upper-case('a')`, &Options{Strict: true})
+	assertErr(t, err)
+}
+
+func Test_func_custom(t *testing.T) {
+	const ns = "urn:test:ext"
+	assertNoErr(t, RegisterFunction(ns, "slugify", &Function{
+		MinArgs: 1,
+		MaxArgs: 1,
+		Args:    []ValueType{StringType},
+		Returns: StringType,
+		Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+			return strings.ReplaceAll(strings.ToLower(args[0].(string)), " ", "-"), nil
+		},
+	}))
+	assertNoErr(t, RegisterFunction(ns, "authors", &Function{
+		MinArgs: 1,
+		MaxArgs: 1,
+		Args:    []ValueType{NodeSetType},
+		Returns: NodeSetType,
+		Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+			var list []NodeNavigator
+			for _, book := range args[0].([]NodeNavigator) {
+				for ok := book.MoveToChild(); ok; ok = book.MoveToNext() {
+					if book.LocalName() == "author" {
+						list = append(list, book.Copy())
+					}
+				}
+			}
+			return list, nil
+		},
+	}))
+	assertNoErr(t, RegisterFunction("", "twice", &Function{
+		MinArgs: 1,
+		MaxArgs: 1,
+		Args:    []ValueType{NumberType},
+		Returns: NumberType,
+		Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+			return args[0].(float64) * 2, nil
+		},
+	}))
+	defer UnregisterFunction(ns, "slugify")
+	defer UnregisterFunction(ns, "authors")
+	defer UnregisterFunction("", "twice")
+
+	namespaces := map[string]string{"ext": ns}
+	expr, err := CompileWithNS(`ext:slugify(//book[1]/title)`, namespaces)
+	assertNoErr(t, err)
+	assertEqual(t, "everyday-italian", expr.Evaluate(createNavigator(book_example)))
+
+	expr, err = CompileWithNS(`count(ext:authors(//book[@category='web']))`, namespaces)
+	assertNoErr(t, err)
+	assertEqual(t, float64(6), expr.Evaluate(createNavigator(book_example)))
+
+	expr, err = CompileWithNS(`ext:authors(//book[1])/text()`, namespaces)
+	assertNoErr(t, err)
+	nodes := iterateNodes(expr.Select(createNavigator(book_example)))
+	assertEqual(t, 1, len(nodes))
+	assertEqual(t, "Giada De Laurentiis", nodes[0].Value())
+
+	test_xpath_eval(t, book_example, `twice(//book[1]/year)`, float64(4010))
+	test_xpath_count(t, book_example, `//book[twice(price) > 90]`, 1)
+
+	_, err = CompileWithNS(`ext:slugify()`, namespaces)
+	assertErr(t, err)
+	_, err = CompileWithNS(`ext:unknown()`, namespaces)
+	assertErr(t, err)
+	// A prefixed name never falls back to the built-in function.
+	for _, s := range []string{`ext:count(//book)`, `none:count(//book)`, `ext:twice(1)`} {
+		_, err = CompileWithNS(s, namespaces)
+		assertErr(t, err)
+	}
+	assertErr(t, RegisterFunction(ns, "bad", &Function{MinArgs: 2, MaxArgs: 1, Call: func(NodeNavigator, []interface{}) (interface{}, error) { return "", nil }}))
+	assertErr(t, RegisterFunction(ns, "bad", &Function{}))
+}
+
 func Benchmark_NormalizeSpaceFunc(b *testing.B) {
 	b.ReportAllocs()
 	const strForNormalization = "\t    \rloooooooonnnnnnngggggggg  \r \n tes  \u00a0 t strin \n\n \r g "
@@ -361,3 +770,14 @@ func Benchmark_GetHashCode(b *testing.B) {
 		}
 	})
 }
+
+func Test_func_distinct_values(t *testing.T) {
+	test_xpath_sequence(t, book_example, `distinct-values(//book/year)`, "2005", "2003")
+	test_xpath_sequence(t, book_example, `distinct-values((1, '1', 1, 2, //book[1]/year, '2005'))`, float64(1), "1", float64(2), "2005")
+	test_xpath_eval(t, book_example, `count(distinct-values((number('a'), number('b'))))`, float64(1))
+	test_xpath_sequence(t, book_example, `distinct-values(())`)
+	test_xpath_eval(t, book_example, `count(distinct-values(//book/@category))`, float64(3))
+
+	_, err := CompileWithOptions(`distinct-values(//book)`, &Options{Strict: true})
+	assertErr(t, err)
+}
@@ -2,6 +2,8 @@ package xpath
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
@@ -93,6 +95,28 @@ func test_xpath_eval(t *testing.T, root *TNode, expr string, expected ...interfa
 	assertEqual(t, expected[0], v)
 }
 
+// test_xpath_sequence checks the items of the sequence result of expr. A
+// node item is checked by its string value.
+func test_xpath_sequence(t *testing.T, root *TNode, expr string, expected ...interface{}) {
+	t.Helper()
+	e, err := Compile(expr)
+	assertNoErr(t, err)
+	seq, err := e.EvaluateSequence(createNavigator(root))
+	assertNoErr(t, err)
+	if len(seq) != len(expected) {
+		t.Fatalf("%s: got %d items, want %d", expr, len(seq), len(expected))
+	}
+	for i, item := range seq {
+		got := item.Value
+		if item.IsNode() {
+			got = item.Node.Value()
+		}
+		if got != expected[i] {
+			t.Errorf("%s: item %d is %v, want %v", expr, i+1, got, expected[i])
+		}
+	}
+}
+
 func Test_Predicates_MultiParent(t *testing.T) {
 	// https://github.com/antchfx/xpath/issues/75
 	/*
@@ -175,9 +199,12 @@ func TestCompile(t *testing.T) {
 
 func TestInvalidXPath(t *testing.T) {
 	var err error
-	_, err = Compile("()")
+	// Sequences are XPath 2.0 expressions.
+	_, err = CompileWithOptions("()", &Options{Strict: true})
 	assertErr(t, err)
-	_, err = Compile("(1,2,3)")
+	_, err = CompileWithOptions("(1,2,3)", &Options{Strict: true})
+	assertErr(t, err)
+	_, err = Compile("(1,2")
 	assertErr(t, err)
 }
 
@@ -193,6 +220,312 @@ func TestCompileUndeclaredVariable(t *testing.T) {
 	}
 }
 
+func TestCompileWithVars(t *testing.T) {
+	expr, err := CompileWithVars("//book[@category=$cat]/title", "cat")
+	assertNoErr(t, err)
+	nav := createNavigator(book_example)
+	nodes := iterateNodes(expr.SelectWithVars(nav, map[string]interface{}{"cat": "web"}))
+	assertEqual(t, 2, len(nodes))
+	assertEqual(t, "XQuery Kick Start", nodes[0].Value())
+	assertEqual(t, "Learning XML", nodes[1].Value())
+	// The same compiled expression is reused with another value.
+	nodes = iterateNodes(expr.SelectWithVars(nav, map[string]interface{}{"cat": "children"}))
+	assertEqual(t, 1, len(nodes))
+	assertEqual(t, "Harry Potter", nodes[0].Value())
+
+	expr = mustCompileWithVars(t, "$n * 2 + count($books)", "n", "books")
+	books := MustCompile("//book").Select(createNavigator(book_example))
+	assertEqual(t, float64(10), expr.EvaluateWithVars(nav, map[string]interface{}{"n": float64(3), "books": books}))
+
+	expr = mustCompileWithVars(t, "$books[2]/title", "books")
+	list := []NodeNavigator{}
+	for iter := MustCompile("//book").Select(createNavigator(book_example)); iter.MoveNext(); {
+		list = append(list, iter.Current().Copy())
+	}
+	nodes = iterateNodes(expr.EvaluateWithVars(nav, map[string]interface{}{"books": list}).(*NodeIterator))
+	assertEqual(t, 1, len(nodes))
+	assertEqual(t, "Harry Potter", nodes[0].Value())
+
+	expr = mustCompileWithVars(t, "//book[$flag]", "flag")
+	assertEqual(t, 0, len(iterateNodes(expr.SelectWithVars(nav, map[string]interface{}{"flag": false}))))
+	assertEqual(t, 4, len(iterateNodes(expr.SelectWithVars(nav, map[string]interface{}{"flag": true}))))
+
+	_, err = CompileWithVars("$x + $y", "x")
+	assertErr(t, err)
+	assertPanic(t, func() {
+		mustCompileWithVars(t, "$x", "x").EvaluateWithVars(nav, map[string]interface{}{"x": struct{}{}})
+	})
+	_, err = mustCompileWithVars(t, "$x", "x").EvaluateWithOptions(nav, &Options{Variables: map[string]interface{}{"x": []int{1}}})
+	assertErr(t, err)
+
+	// Go numbers are XPath numbers, and a []string is a sequence of strings.
+	expr = mustCompileWithVars(t, "$i + $u + $f", "i", "u", "f")
+	assertEqual(t, 6.5, expr.EvaluateWithVars(nav, map[string]interface{}{"i": 1, "u": uint8(2), "f": float32(3.5)}))
+	expr = mustCompileWithVars(t, "count(//book[@category = $cats])", "cats")
+	assertEqual(t, float64(3), expr.EvaluateWithVars(nav, map[string]interface{}{"cats": []string{"web", "cooking"}}))
+
+	// A path from the bound nodes does not move them.
+	expr = mustCompileWithVars(t, "count($books/title) + count($books[self::book])", "books")
+	assertEqual(t, float64(8), expr.EvaluateWithVars(nav, map[string]interface{}{"books": list}))
+	assertEqual(t, "book", list[0].LocalName())
+}
+
+func TestUnboundVariables(t *testing.T) {
+	nav := createNavigator(book_example)
+	expr := mustCompileWithVars(t, "//book[@category = $cat]", "cat")
+	assertEqual(t, &VariableError{Name: "cat"}, expr.Evaluate(nav))
+	assertEqual(t, &VariableError{Name: "cat"}, expr.EvaluateWithVars(nav, map[string]interface{}{"x": "web"}))
+	iter := expr.Select(nav)
+	assertFalse(t, iter.MoveNext())
+	assertEqual(t, &VariableError{Name: "cat"}, iter.Err())
+	iter = expr.SelectWithVars(nav, nil)
+	assertFalse(t, iter.MoveNext())
+	assertEqual(t, &VariableError{Name: "cat"}, iter.Err())
+	_, err := expr.EvaluateWithOptions(nav, &Options{})
+	assertEqual(t, &VariableError{Name: "cat"}, err)
+	_, err = expr.EvaluateSequence(nav)
+	assertEqual(t, &VariableError{Name: "cat"}, err)
+
+	// The variables of for, some, every and let expressions need no value.
+	expr = mustCompileWithVars(t, "count(for $cat in ('web') return //book[@category = $cat])", "cat")
+	assertEqual(t, float64(2), expr.Evaluate(nav))
+	expr = mustCompileWithVars(t, "(for $cat in ('web') return $cat, $cat)", "cat")
+	assertEqual(t, &VariableError{Name: "cat"}, expr.Evaluate(nav))
+}
+
+func mustCompileWithVars(t *testing.T, expr string, vars ...string) *Expr {
+	e, err := CompileWithVars(expr, vars...)
+	assertNoErr(t, err)
+	return e
+}
+
+func TestCompileWithOptions(t *testing.T) {
+	ctx := &Options{
+		Namespaces: map[string]string{"x": "http://www.contoso.com/books", "ext": "urn:test:ctx"},
+		Variables:  map[string]interface{}{"title": "Midnight Rain"},
+		Functions: FunctionResolverFunc(func(ns, name string) *Function {
+			if ns != "urn:test:ctx" || name != "upper" {
+				return nil
+			}
+			return &Function{
+				MinArgs: 1,
+				MaxArgs: 1,
+				Args:    []ValueType{StringType},
+				Returns: StringType,
+				Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+					return strings.ToUpper(args[0].(string)), nil
+				},
+			}
+		}),
+	}
+	expr, err := CompileWithOptions(`ext:upper(//x:book[title=$title]/author)`, ctx)
+	assertNoErr(t, err)
+	v, err := expr.EvaluateWithOptions(createNavigator(mybook_example), ctx)
+	assertNoErr(t, err)
+	assertEqual(t, "RALLS, KIM", v)
+
+	// Runtime errors are returned rather than raised.
+	_, err = expr.EvaluateWithOptions(createNavigator(mybook_example), nil)
+	assertErr(t, err)
+
+	_, err = CompileWithOptions(`lower-case('A')`, &Options{Strict: true})
+	assertErr(t, err)
+	_, err = CompileWithOptions(`lower-case('A')`, nil)
+	assertNoErr(t, err)
+
+	// Strict mode allows only the XPath 1.0 core functions, and the custom
+	// functions when StrictCustomFunctions is set.
+	for _, s := range []string{`key('k', 'a')`, `format-number(1, '0')`, `generate-id()`, `system-property('xsl:version')`, `element-available('xsl:if')`, `fn:count(/)`} {
+		_, err = CompileWithOptions(s, &Options{Strict: true, Keys: map[string]Key{"k": {Match: "a", Use: "."}}})
+		assertErr(t, err)
+	}
+	_, err = CompileWithOptions(`translate(substring-after(name(/*), ':'), 'a', 'b')`, &Options{Strict: true})
+	assertNoErr(t, err)
+	ctx.Strict = true
+	_, err = CompileWithOptions(`ext:upper('a')`, ctx)
+	assertErr(t, err)
+	ctx.StrictCustomFunctions = true
+	_, err = CompileWithOptions(`ext:upper('a')`, ctx)
+	assertNoErr(t, err)
+	_, err = CompileWithOptions(`ext:lower('a')`, ctx)
+	assertErr(t, err)
+	_, err = CompileWithOptions(`not(not(not(true())))`, &Options{Limits: Limits{MaxDepth: 3}})
+	assertErr(t, err)
+}
+
+func TestEvaluateCancel(t *testing.T) {
+	expr := MustCompile("//book/title | //book/author")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v, err := expr.EvaluateWithOptions(createNavigator(book_example), &Options{Context: ctx})
+	assertNoErr(t, err)
+	iter := v.(*NodeIterator)
+	assertEqual(t, true, iter.MoveNext())
+	cancel()
+	assertEqual(t, false, iter.MoveNext())
+	assertEqual(t, context.Canceled, iter.Err())
+
+	iter = MustCompile("//book").SelectWithOptions(createNavigator(book_example), &Options{Context: ctx})
+	assertEqual(t, false, iter.MoveNext())
+	assertEqual(t, context.Canceled, iter.Err())
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = MustCompile("count(//*)").EvaluateWithOptions(createNavigator(book_example), &Options{Context: ctx})
+	assertEqual(t, context.DeadlineExceeded, err)
+
+	iter = MustCompile("//book").SelectWithOptions(createNavigator(book_example), &Options{Context: context.Background()})
+	n := 0
+	for iter.MoveNext() {
+		n++
+	}
+	assertEqual(t, 4, n)
+	assertNoErr(t, iter.Err())
+
+	// The context, the variables and the limits apply together.
+	expr = mustCompileWithVars(t, "//book[@category = $cat]/title", "cat")
+	opts := &Options{
+		Context:   context.Background(),
+		Variables: map[string]interface{}{"cat": "web"},
+		Limits:    Limits{MaxResultSize: 1},
+	}
+	iter = expr.SelectWithOptions(createNavigator(book_example), opts)
+	assertEqual(t, true, iter.MoveNext())
+	assertEqual(t, "XQuery Kick Start", iter.Current().Value())
+	assertEqual(t, false, iter.MoveNext())
+	var limitErr *LimitError
+	assertTrue(t, errors.As(iter.Err(), &limitErr))
+	opts.Context = ctx
+	_, err = expr.EvaluateWithOptions(createNavigator(book_example), opts)
+	assertEqual(t, context.DeadlineExceeded, err)
+}
+
+func TestEvaluateLimits(t *testing.T) {
+	eval := func(expr string, limits Limits) (interface{}, error) {
+		return MustCompile(expr).EvaluateWithOptions(createNavigator(book_example), &Options{Limits: limits})
+	}
+	assertLimit := func(err error, limit string) {
+		t.Helper()
+		e, ok := err.(*LimitError)
+		if !ok || e.Limit != limit {
+			t.Fatalf("expected %s LimitError, got %v", limit, err)
+		}
+	}
+
+	_, err := eval("count(//*)", Limits{MaxNodesVisited: 10})
+	assertLimit(err, "MaxNodesVisited")
+	v, err := eval("count(//book)", Limits{MaxNodesVisited: 1000})
+	assertNoErr(t, err)
+	assertEqual(t, float64(4), v)
+
+	_, err = eval("count(//title | //author)", Limits{MaxBufferedNodes: 4})
+	assertLimit(err, "MaxBufferedNodes")
+	_, err = eval("count(reverse(//book))", Limits{MaxBufferedNodes: 2})
+	assertLimit(err, "MaxBufferedNodes")
+	// The steps that select their nodes in document order are not buffered.
+	v, err = eval("count(//book/title)", Limits{MaxBufferedNodes: 1})
+	assertNoErr(t, err)
+	assertEqual(t, float64(4), v)
+	v, err = eval("count(//title/@lang)", Limits{MaxBufferedNodes: 1})
+	assertNoErr(t, err)
+	assertEqual(t, float64(4), v)
+
+	_, err = eval("concat(//book[1]/title, //book[2]/title)", Limits{MaxStringLength: 10})
+	assertLimit(err, "MaxStringLength")
+	_, err = eval("string-join(//book/title, ',')", Limits{MaxStringLength: 10})
+	assertLimit(err, "MaxStringLength")
+
+	v, err = eval("//book", Limits{MaxResultSize: 2})
+	assertNoErr(t, err)
+	iter := v.(*NodeIterator)
+	assertEqual(t, true, iter.MoveNext())
+	assertEqual(t, true, iter.MoveNext())
+	assertEqual(t, false, iter.MoveNext())
+	assertLimit(iter.Err(), "MaxResultSize")
+}
+
+func TestEvaluateLimitCounts(t *testing.T) {
+	nav := createNavigator(book_example)
+	count := func(expr string) int {
+		return int(MustCompile(expr).Evaluate(nav).(float64))
+	}
+	// exactly checks that the evaluation of expr uses exactly n of the limit
+	// set by limits.
+	exactly := func(expr string, n int, limits func(int) Limits, opts *Options) {
+		t.Helper()
+		e, err := CompileWithOptions(expr, opts)
+		assertNoErr(t, err)
+		opts.Limits = limits(n)
+		if _, err := e.EvaluateWithOptions(nav, opts); err != nil {
+			t.Fatalf("%s with a limit of %d: %v", expr, n, err)
+		}
+		opts.Limits = limits(n - 1)
+		if _, err := e.EvaluateWithOptions(nav, opts); err == nil {
+			t.Fatalf("%s with a limit of %d: expected a LimitError", expr, n-1)
+		}
+	}
+	visited := func(n int) Limits { return Limits{MaxNodesVisited: n} }
+	buffered := func(n int) Limits { return Limits{MaxBufferedNodes: n} }
+
+	// A node is visited each time an axis tests it.
+	exactly("count(/bookstore/book)", count("count(/node()) + count(/bookstore/node())"), visited, &Options{})
+	exactly("count(//book)", count("count(//node())"), visited, &Options{})
+	exactly("count(//book/@category)", count("count(//node()) + count(//book/@*)"), visited, &Options{})
+	exactly("count(//book | //book)", 2*count("count(//node())"), visited, &Options{})
+
+	// A node is buffered each time it is copied into a list.
+	exactly("count(reverse(//book))", 4, buffered, &Options{})
+	exactly("count(//title | //book[1]/title)", 6, buffered, &Options{})
+	// Integers are not nodes.
+	v, err := MustCompile("count((1 to 10) ! .)").EvaluateWithOptions(nav, &Options{Limits: buffered(1)})
+	assertNoErr(t, err)
+	assertEqual(t, float64(10), v)
+	// The nodes of a custom function are buffered.
+	opts := &Options{
+		Namespaces: map[string]string{"ext": "urn:test:limits"},
+		Functions: FunctionResolverFunc(func(ns, name string) *Function {
+			return &Function{MinArgs: 1, MaxArgs: 1, Args: []ValueType{NodeSetType}, Returns: NodeSetType,
+				Call: func(_ NodeNavigator, args []interface{}) (interface{}, error) {
+					return args[0].([]NodeNavigator)[:1], nil
+				},
+			}
+		}),
+	}
+	exactly("count(ext:first(//title))", 5, buffered, opts)
+
+	// A sequence is measured in items as it is built.
+	items := func(n int) Limits { return Limits{MaxSequenceLength: n} }
+	exactly("count((1 to 3, 4 to 5))", 5, items, &Options{})
+	exactly("count(for $i in 1 to 4 return ($i, $i))", 8, items, &Options{})
+
+	// A string is measured in bytes as it is built.
+	length := func(n int) Limits { return Limits{MaxStringLength: n} }
+	exactly("concat('ab', 'cde', 'f')", 6, length, &Options{})
+	exactly("string-join(('ab', 'cde', 'f'), '--')", 10, length, &Options{})
+	exactly("replace('a-b-c', '-', '+++')", 9, length, &Options{})
+	called := false
+	opts = &Options{
+		Namespaces: map[string]string{"ext": "urn:test:limits"},
+		Functions: FunctionResolverFunc(func(ns, name string) *Function {
+			return &Function{Returns: StringType,
+				Call: func(NodeNavigator, []interface{}) (interface{}, error) {
+					called = true
+					return "", nil
+				},
+			}
+		}),
+		Limits: length(2),
+	}
+	e, err := CompileWithOptions("concat('abc', ext:later())", opts)
+	assertNoErr(t, err)
+	_, err = e.EvaluateWithOptions(nav, opts)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxStringLength" {
+		t.Fatalf("expected a MaxStringLength LimitError, got %v", err)
+	}
+	assertEqual(t, false, called)
+}
+
 func TestCompileWithNS(t *testing.T) {
 	_, err := CompileWithNS("/foo", nil)
 	assertNil(t, err)
@@ -240,6 +573,125 @@ func TestNamespacePrefixQuery(t *testing.T) {
 	assertEqual(t, "book3", nodes[1].Value())
 }
 
+// nsNavigator is a TNodeNavigator that exposes the namespaces declared by
+// xmlns attributes as namespace nodes.
+type nsNavigator struct {
+	*TNodeNavigator
+	ns int
+}
+
+func (n *nsNavigator) namespaces() []Attribute {
+	list := []Attribute{{"xml", "http://www.w3.org/XML/1998/namespace"}}
+	seen := map[string]bool{"xml": true}
+	for node := n.curr; node != nil; node = node.Parent {
+		for _, a := range node.Attr {
+			if prefix := strings.TrimPrefix(a.Key, "xmlns:"); prefix != a.Key && !seen[prefix] {
+				seen[prefix] = true
+				list = append(list, Attribute{prefix, a.Value})
+			}
+		}
+	}
+	return list
+}
+
+func (n *nsNavigator) NodeType() NodeType {
+	if n.ns != -1 {
+		return NamespaceNode
+	}
+	return n.TNodeNavigator.NodeType()
+}
+
+func (n *nsNavigator) LocalName() string {
+	if n.ns != -1 {
+		return n.namespaces()[n.ns].Key
+	}
+	return n.TNodeNavigator.LocalName()
+}
+
+func (n *nsNavigator) Prefix() string {
+	if n.ns != -1 {
+		return ""
+	}
+	return n.TNodeNavigator.Prefix()
+}
+
+func (n *nsNavigator) Value() string {
+	if n.ns != -1 {
+		return n.namespaces()[n.ns].Value
+	}
+	return n.TNodeNavigator.Value()
+}
+
+func (n *nsNavigator) Copy() NodeNavigator {
+	return &nsNavigator{n.TNodeNavigator.Copy().(*TNodeNavigator), n.ns}
+}
+
+func (n *nsNavigator) MoveTo(other NodeNavigator) bool {
+	o, ok := other.(*nsNavigator)
+	if !ok || !n.TNodeNavigator.MoveTo(o.TNodeNavigator) {
+		return false
+	}
+	n.ns = o.ns
+	return true
+}
+
+func (n *nsNavigator) MoveToRoot() {
+	n.ns = -1
+	n.TNodeNavigator.MoveToRoot()
+}
+
+func (n *nsNavigator) MoveToParent() bool {
+	if n.ns != -1 {
+		n.ns = -1
+		return true
+	}
+	return n.TNodeNavigator.MoveToParent()
+}
+
+func (n *nsNavigator) MoveToChild() bool {
+	return n.ns == -1 && n.TNodeNavigator.MoveToChild()
+}
+
+func (n *nsNavigator) MoveToNext() bool {
+	return n.ns == -1 && n.TNodeNavigator.MoveToNext()
+}
+
+func (n *nsNavigator) MoveToPrevious() bool {
+	return n.ns == -1 && n.TNodeNavigator.MoveToPrevious()
+}
+
+func (n *nsNavigator) MoveToNextAttribute() bool {
+	return n.ns == -1 && n.TNodeNavigator.MoveToNextAttribute()
+}
+
+func (n *nsNavigator) MoveToNextNamespace() bool {
+	if n.attr != -1 || n.ns+1 >= len(n.namespaces()) {
+		return false
+	}
+	n.ns++
+	return true
+}
+
+func TestNamespaceAxis(t *testing.T) {
+	nav := &nsNavigator{createNavigator(mybook_example), -1}
+	values := func(expr string) []string {
+		var list []string
+		for iter := MustCompile(expr).Select(nav.Copy()); iter.MoveNext(); {
+			list = append(list, iter.Current().LocalName()+"="+iter.Current().Value())
+		}
+		return list
+	}
+	assertEqual(t, []string{"xml=http://www.w3.org/XML/1998/namespace", "mybook=http://www.contoso.com/books"}, values("/books/namespace::*"))
+	assertEqual(t, []string{"mybook=http://www.contoso.com/books"}, values("/books/namespace::mybook"))
+	assertEqual(t, []string(nil), values("/books/namespace::none"))
+	assertEqual(t, 2, len(values("//title/namespace::mybook")))
+	assertEqual(t, 2, len(values("//title/namespace::mybook/..")))
+	assertEqual(t, float64(2), MustCompile("count(/books/namespace::node())").Evaluate(nav.Copy()))
+
+	// A navigator without namespace nodes has an empty namespace axis.
+	test_xpath_count(t, mybook_example, "//namespace::*", 0)
+}
+
 func TestMustCompile(t *testing.T) {
 	expr := MustCompile("//")
 	assertTrue(t, expr != nil)
@@ -296,6 +748,20 @@ func TestNodeType(t *testing.T) {
 	n := selectNode(doc, "//comment()")
 	assertTrue(t, n != nil)
 	assertEqual(t, CommentNode, n.Type)
+
+	doc = createNode("", RootNode)
+	doc.createChildNode(`xml-stylesheet href="style.xsl"`, ProcessingInstructionNode)
+	doc.createChildNode(`page size="A4"`, ProcessingInstructionNode)
+	doc.createChildNode("root", ElementNode).createChildNode(`page size="A5"`, ProcessingInstructionNode)
+	test_xpath_count(t, doc, "//processing-instruction()", 3)
+	test_xpath_count(t, doc, "/processing-instruction('page')", 1)
+	test_xpath_count(t, doc, "//processing-instruction('page')", 2)
+	test_xpath_count(t, doc, "//processing-instruction('none')", 0)
+	test_xpath_count(t, doc, "/*", 1)
+	test_xpath_count(t, doc, "/node()", 3)
+	test_xpath_eval(t, doc, "string(/processing-instruction('xml-stylesheet'))", `href="style.xsl"`)
+	test_xpath_eval(t, doc, "name(//root/processing-instruction())", "page")
+	test_xpath_eval(t, doc, "count(//processing-instruction() | /processing-instruction('page'))", float64(3))
 }
 
 func iterateNavs(t *NodeIterator) []*TNodeNavigator {
@@ -425,6 +891,9 @@ func (n *TNodeNavigator) LocalName() string {
 	if n.attr != -1 {
 		return n.curr.Attr[n.attr].Key
 	}
+	if n.curr.Type == ProcessingInstructionNode {
+		return strings.SplitN(n.curr.Data, " ", 2)[0]
+	}
 	name := n.curr.Data
 	if strings.Contains(name, ":") {
 		return strings.Split(name, ":")[1]
@@ -469,6 +938,10 @@ func (n *TNodeNavigator) Value() string {
 		return buf.String()
 	case TextNode:
 		return n.curr.Data
+	case ProcessingInstructionNode:
+		if i := strings.IndexByte(n.curr.Data, ' '); i >= 0 {
+			return n.curr.Data[i+1:]
+		}
 	}
 	return ""
 }